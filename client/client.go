@@ -57,8 +57,9 @@ func ReceiveResponse(c *net.UnixConn) (*server.Response, error) {
 		return nil, err
 	}
 	payload := make([]byte, length)
-	n, err := c.Read(payload)
-	if err != nil && err != io.EOF {
+	// Large responses (e.g. status) arrive in several reads.
+	n, err := io.ReadFull(c, payload)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, err
 	} else if n != length {
 		return nil, fmt.Errorf("Read %d bytes and expected %d bytes", n, length)
@@ -0,0 +1,116 @@
+// Copyright © 2016 Adam Kramer <akramer@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/akramer/lateral/client"
+	"github.com/akramer/lateral/server"
+	"github.com/spf13/cobra"
+)
+
+var cancelAllPending, cancelRunning bool
+var cancelSignal string
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
+
+// Parse a signal given as a number, or a name with or without the SIG prefix.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("Unknown signal %q", s)
+}
+
+func runCancelCmd(cmd *cobra.Command, args []string) {
+	sig, err := parseSignal(cancelSignal)
+	if err != nil {
+		panic(err)
+	}
+	cancel := &server.RequestCancel{
+		AllPending: cancelAllPending,
+		Running:    cancelRunning,
+		Signal:     int(sig),
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Errorf("Invalid task ID %q", arg))
+		}
+		cancel.Ids = append(cancel.Ids, id)
+	}
+	if len(cancel.Ids) == 0 && !cancel.AllPending && !cancel.Running {
+		panic(fmt.Errorf("No tasks specified: give task IDs, --all-pending or --running"))
+	}
+	c, err := client.NewUnixConn(Viper)
+	if err != nil {
+		panic(fmt.Errorf("Error connecting to server: %v", err))
+	}
+	defer c.Close()
+	req := &server.Request{
+		Type:   server.REQUEST_CANCEL,
+		Cancel: cancel,
+	}
+	err = client.SendRequest(c, req)
+	if err != nil {
+		panic(fmt.Errorf("Error sending request: %v", err))
+	}
+	resp, err := client.ReceiveResponse(c)
+	if err != nil {
+		panic(fmt.Errorf("Error receiving response: %v", err))
+	}
+	if resp.Type != server.RESPONSE_CANCEL {
+		panic(fmt.Errorf("Error in server response: %v", resp.Message))
+	}
+	for _, id := range resp.Cancel.Finished {
+		fmt.Fprintf(os.Stderr, "Task %d has already finished or exited\n", id)
+	}
+}
+
+// cancelCmd represents the cancel command
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [<id>...]",
+	Short: "Cancel pending or running tasks",
+	Long: `Cancel the given tasks. Pending tasks are never run, and running tasks are sent
+a signal (SIGTERM by default), along with the processes they started. Cancelled
+tasks are recorded as such, and don't count as failures in 'lateral wait'.`,
+	Run: runCancelCmd,
+}
+
+func init() {
+	RootCmd.AddCommand(cancelCmd)
+
+	cancelCmd.Flags().BoolVar(&cancelAllPending, "all-pending", false, "Cancel every pending task")
+	cancelCmd.Flags().BoolVar(&cancelRunning, "running", false, "Cancel every running task")
+	cancelCmd.Flags().StringVar(&cancelSignal, "signal", "TERM", "Signal sent to running tasks")
+}
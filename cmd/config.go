@@ -23,15 +23,19 @@ import (
 )
 
 var configParallel int
+var configGroup string
 
 // configCmd represents the config command
 var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "Change the server configuration",
-	Long:  `Connect to the lateral server and change its configuration.`,
+	Long: `Connect to the lateral server and change its configuration.
+With --group, the parallelism of that group of tasks is changed instead of the
+server's. Group limits are nested under the server's: a task only starts when
+both have a free slot. A negative parallelism removes a group's limit.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		config := &server.RequestConfig{}
-		if configParallel != -1 {
+		config := &server.RequestConfig{Group: configGroup}
+		if cmd.Flags().Changed("parallel") {
 			config.Parallel = &configParallel
 		}
 		c, err := client.NewUnixConn(Viper)
@@ -60,5 +64,6 @@ var configCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(configCmd)
 
-	configCmd.Flags().IntVarP(&configParallel, "parallel", "p", -1, "Number of parallel tasks to run")
+	configCmd.Flags().IntVarP(&configParallel, "parallel", "p", 0, "Number of parallel tasks to run. With --group, a negative value removes the group's limit.")
+	configCmd.Flags().StringVarP(&configGroup, "group", "g", "", "Apply the configuration to this group of tasks")
 }
@@ -0,0 +1,127 @@
+// Copyright © 2016 Adam Kramer <akramer@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/akramer/lateral/client"
+	"github.com/akramer/lateral/server"
+	"github.com/spf13/cobra"
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs <id>",
+	Short: "Print the output of a task",
+	Long: `Print the stdout and stderr of a task, as kept by a server started with
+--spool. Output beyond the server's --spool-task-max is not kept, and the
+output of the oldest tasks is removed once the total reaches --spool-max.
+
+With -f, keep printing the output as the task writes it until the task
+finishes, waiting for it to start if it is still pending.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			panic(fmt.Errorf("Expected a task ID"))
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			panic(fmt.Errorf("Invalid task ID %q", args[0]))
+		}
+		path := server.SpoolFile(Viper.GetString("socket"), id)
+		if Viper.GetBool("logs.follow") {
+			followSpool(path, waitFinished(id))
+			return
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			panic(fmt.Errorf("No output kept for task %d", id))
+		} else if err != nil {
+			panic(fmt.Errorf("Error reading output: %v", err))
+		}
+		defer f.Close()
+		if _, err = io.Copy(os.Stdout, f); err != nil {
+			panic(fmt.Errorf("Error reading output: %v", err))
+		}
+	},
+}
+
+// Returns a channel that is closed once task id has finished, or the server
+// can't tell whether it has.
+func waitFinished(id int) <-chan struct{} {
+	done := make(chan struct{})
+	c, err := client.NewUnixConn(Viper)
+	if err != nil {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		defer c.Close()
+		err := client.SendRequest(c, &server.Request{
+			Type: server.REQUEST_WAIT,
+			Wait: &server.RequestWait{Ids: []int{id}},
+		})
+		if err == nil {
+			client.ReceiveResponse(c)
+		}
+	}()
+	return done
+}
+
+// Print the spool file at path as it grows, until done is closed.
+func followSpool(path string, done <-chan struct{}) {
+	var f *os.File
+	for {
+		// Everything written before the task finished is read below.
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if f == nil {
+			var err error
+			f, err = os.Open(path)
+			if err != nil && !os.IsNotExist(err) {
+				panic(fmt.Errorf("Error reading output: %v", err))
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(os.Stdout, f); err != nil {
+				panic(fmt.Errorf("Error reading output: %v", err))
+			}
+		}
+		if finished {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if f == nil {
+		panic(fmt.Errorf("No output kept for the task"))
+	}
+	f.Close()
+}
+
+func init() {
+	RootCmd.AddCommand(logsCmd)
+
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep printing output until the task finishes")
+	Viper.BindPFlag("logs.follow", logsCmd.Flags().Lookup("follow"))
+}
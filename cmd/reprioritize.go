@@ -0,0 +1,72 @@
+// Copyright © 2016 Adam Kramer <akramer@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/akramer/lateral/client"
+	"github.com/akramer/lateral/server"
+	"github.com/spf13/cobra"
+)
+
+// reprioritizeCmd represents the reprioritize command
+var reprioritizeCmd = &cobra.Command{
+	Use:   "reprioritize <id> <priority>",
+	Short: "Change the priority of a pending task",
+	Long: `Change the priority of a pending task. Pending tasks with a higher priority are
+run first. Use -- before a negative priority.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			panic(fmt.Errorf("Expected a task ID and a priority"))
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			panic(fmt.Errorf("Invalid task ID %q", args[0]))
+		}
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			panic(fmt.Errorf("Invalid priority %q", args[1]))
+		}
+		c, err := client.NewUnixConn(Viper)
+		if err != nil {
+			panic(fmt.Errorf("Error connecting to server: %v", err))
+		}
+		defer c.Close()
+		req := &server.Request{
+			Type: server.REQUEST_REPRIORITIZE,
+			Reprioritize: &server.RequestReprioritize{
+				Id:       id,
+				Priority: priority,
+			},
+		}
+		err = client.SendRequest(c, req)
+		if err != nil {
+			panic(fmt.Errorf("Error sending request: %v", err))
+		}
+		resp, err := client.ReceiveResponse(c)
+		if err != nil {
+			panic(fmt.Errorf("Error receiving response: %v", err))
+		}
+		if resp.Type != server.RESPONSE_OK {
+			panic(fmt.Errorf("Error in server response: %v", resp.Message))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reprioritizeCmd)
+}
@@ -16,8 +16,13 @@ package cmd
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/akramer/lateral/client"
 	"github.com/akramer/lateral/platform"
@@ -25,11 +30,34 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var runRetryOn, runAfter []int
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run the given command in the lateral server",
-	Long:  `A longer description that spans multiple lines and likely contains examples`,
+	Long: `Queue the given command to be run by the lateral server.
+The ID the server assigned to the task is printed to stdout, unless --quiet is given.
+
+With --sync, lateral instead waits for the task to finish, and exits with its
+exit status, or 128 plus the number of the signal that killed it. SIGINT,
+SIGTERM and SIGHUP received while waiting are passed on to the task, as with
+'lateral cancel --signal'. A task that is signalled before it starts is
+cancelled.
+
+With --tag or --line-prefix, the server passes on the task's output a line at
+a time, each line starting with a prefix. These placeholders in --line-prefix
+are replaced:
+  {id}     the task's ID
+  {group}  the task's group
+  {args}   the command's arguments, separated by spaces
+  {argN}   argument N, where {arg0} is the command itself
+--tag is short for --line-prefix '{args}<TAB>', so the two can't be combined.
+
+--stdin, --stdout and --stderr name files for the server to open when the task
+starts, relative to the current directory and with the same placeholders, so
+'--stdout logs/{id}.out' gives each task its own log. The fds they replace
+aren't passed to the server.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			panic(fmt.Errorf("No command specified"))
@@ -38,6 +66,12 @@ var runCmd = &cobra.Command{
 		if err != nil {
 			panic(fmt.Errorf("Failed to determine filedescriptors to send: %v", err))
 		}
+		redirects := []string{
+			Viper.GetString("run.stdin"),
+			Viper.GetString("run.stdout"),
+			Viper.GetString("run.stderr"),
+		}
+		fds = withoutRedirected(fds, redirects)
 		c, err := client.NewUnixConn(Viper)
 		if err != nil {
 			panic(fmt.Errorf("Error connecting to server: %v", err))
@@ -53,15 +87,57 @@ var runCmd = &cobra.Command{
 		}
 		req := &server.Request{
 			Type:   server.REQUEST_RUN,
-			HasFds: true,
+			HasFds: len(fds) > 0,
 			Fds:    fds,
 			Run: &server.RequestRun{
-				Exe:  exe,
-				Args: args,
-				Env:  os.Environ(),
-				Cwd:  wd,
+				Exe:        exe,
+				Args:       args,
+				Env:        os.Environ(),
+				Cwd:        wd,
+				Timeout:    Viper.GetDuration("run.timeout"),
+				KillAfter:  Viper.GetDuration("run.kill_after"),
+				Retries:    Viper.GetInt("run.retries"),
+				RetryDelay: Viper.GetDuration("run.retry_delay"),
+				Backoff:    Viper.GetString("run.backoff"),
+				RetryOn:    runRetryOn,
+				Priority:   Viper.GetInt("run.priority"),
+				After:      runAfter,
+				Group:      Viper.GetString("run.group"),
+				Stdin:      redirects[0],
+				Stdout:     redirects[1],
+				Stderr:     redirects[2],
 			},
 		}
+		prefix := Viper.GetString("run.line_prefix")
+		if Viper.GetBool("run.tag") {
+			if prefix != "" {
+				panic(fmt.Errorf("--tag can't be combined with --line-prefix"))
+			}
+			prefix = "{args}\t"
+		}
+		timestamp, color := Viper.GetBool("run.timestamp"), Viper.GetBool("run.color")
+		lines := prefix != "" || timestamp || color
+		keep := Viper.GetBool("run.keep_order")
+		if (keep || Viper.GetBool("run.group_output")) && lines {
+			panic(fmt.Errorf("--group-output and --keep-order can't be combined with --tag, --line-prefix, --timestamp or --color"))
+		}
+		if keep {
+			req.Run.Output = "keep"
+		} else if Viper.GetBool("run.group_output") {
+			req.Run.Output = "group"
+		} else if lines {
+			req.Run.Output = "line"
+			req.Run.LinePrefix = prefix
+			req.Run.Timestamp = timestamp
+			req.Run.Color = color
+		}
+		synchronous := Viper.GetBool("run.sync")
+		// Catch signals from the start, so none are lost before the task's ID
+		// is known.
+		sigs := make(chan os.Signal, 1)
+		if synchronous {
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		}
 		err = client.SendRequest(c, req)
 		if err != nil {
 			panic(fmt.Errorf("Error sending request: %v", err))
@@ -70,13 +146,143 @@ var runCmd = &cobra.Command{
 		if err != nil {
 			panic(fmt.Errorf("Error receiving response: %v", err))
 		}
-		if resp.Type != server.RESPONSE_OK {
+		if resp.Type != server.RESPONSE_RUN {
 			panic(fmt.Errorf("Error in server response: %v", resp.Message))
 		}
+		if synchronous {
+			ExitCode = runSync(c, resp.Run.Id, sigs)
+		} else if !Viper.GetBool("run.quiet") {
+			fmt.Printf("%d\n", resp.Run.Id)
+		}
 	},
 }
 
+// Returns fds without those that the server replaces with redirects, indexed
+// by fd, so it doesn't have to hold them open.
+func withoutRedirected(fds []int, redirects []string) []int {
+	var kept []int
+	for _, fd := range fds {
+		if fd >= len(redirects) || redirects[fd] == "" {
+			kept = append(kept, fd)
+		}
+	}
+	return kept
+}
+
+// The last signal forwarded by forwardSignals
+var forwardedSignal int32
+
+// Wait on c for task id to finish and return its exit status, forwarding
+// signals from sigs to the task in the meantime.
+func runSync(c *net.UnixConn, id int, sigs chan os.Signal) int {
+	go forwardSignals(id, sigs)
+	err := client.SendRequest(c, &server.Request{
+		Type: server.REQUEST_WAIT,
+		Wait: &server.RequestWait{Ids: []int{id}},
+	})
+	if err != nil {
+		panic(fmt.Errorf("Error sending request: %v", err))
+	}
+	resp, err := client.ReceiveResponse(c)
+	if err != nil {
+		panic(fmt.Errorf("Error receiving response: %v", err))
+	}
+	if resp.Type != server.RESPONSE_WAIT {
+		panic(fmt.Errorf("Error in server response: %v", resp.Message))
+	}
+	t := &resp.Wait.Tasks[0]
+	if t.Skipped != "" {
+		fmt.Fprintf(os.Stderr, "Task %d was skipped: %s\n", id, t.Skipped)
+	}
+	if sig := atomic.LoadInt32(&forwardedSignal); t.Cancelled && t.Pid == 0 && sig != 0 {
+		// Cancelled before it ran, so report the signal as if it had
+		// killed the task.
+		return 128 + int(sig)
+	}
+	return t.ExitCode()
+}
+
+// Pass each signal received on sigs to task id, over a new connection so the
+// pending wait isn't disturbed.
+func forwardSignals(id int, sigs chan os.Signal) {
+	for sig := range sigs {
+		s := sig.(syscall.Signal)
+		atomic.StoreInt32(&forwardedSignal, int32(s))
+		err := sendSignal(id, s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to forward %v to task %d: %v\n", sig, id, err)
+		}
+	}
+}
+
+func sendSignal(id int, sig syscall.Signal) error {
+	c, err := client.NewUnixConn(Viper)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	err = client.SendRequest(c, &server.Request{
+		Type: server.REQUEST_CANCEL,
+		Cancel: &server.RequestCancel{
+			Ids:    []int{id},
+			Signal: int(sig),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := client.ReceiveResponse(c)
+	if err != nil {
+		return err
+	}
+	if resp.Type != server.RESPONSE_CANCEL {
+		return fmt.Errorf("%v", resp.Message)
+	}
+	return nil
+}
+
 func init() {
 	RootCmd.AddCommand(runCmd)
 
+	// Everything after the command name belongs to the command, not to lateral.
+	runCmd.Flags().SetInterspersed(false)
+	runCmd.Flags().BoolP("quiet", "q", false, "Do not print the ID of the queued task")
+	Viper.BindPFlag("run.quiet", runCmd.Flags().Lookup("quiet"))
+	runCmd.Flags().Bool("sync", false, "Wait for the task to finish and exit with its exit status, instead of printing its ID")
+	Viper.BindPFlag("run.sync", runCmd.Flags().Lookup("sync"))
+	runCmd.Flags().Duration("timeout", 0, "Send the task SIGTERM if it runs longer than this (default: the server's --timeout)")
+	Viper.BindPFlag("run.timeout", runCmd.Flags().Lookup("timeout"))
+	runCmd.Flags().Duration("kill-after", 0, "Send SIGKILL if the task is still running this long after a timeout (default: the server's --kill-after)")
+	Viper.BindPFlag("run.kill_after", runCmd.Flags().Lookup("kill-after"))
+	runCmd.Flags().Int("retries", 0, "Number of times to re-run the task if it fails")
+	Viper.BindPFlag("run.retries", runCmd.Flags().Lookup("retries"))
+	runCmd.Flags().Duration("retry-delay", time.Second, "Delay before the first retry")
+	Viper.BindPFlag("run.retry_delay", runCmd.Flags().Lookup("retry-delay"))
+	runCmd.Flags().String("backoff", "const", "How the delay grows between retries: const, linear or exp (doubling up to an hour)")
+	Viper.BindPFlag("run.backoff", runCmd.Flags().Lookup("backoff"))
+	runCmd.Flags().IntSliceVar(&runRetryOn, "retry-on", nil, "Only retry these exit statuses (default: any failure)")
+	runCmd.Flags().Int("priority", 0, "Pending tasks with a higher priority are run first")
+	Viper.BindPFlag("run.priority", runCmd.Flags().Lookup("priority"))
+	runCmd.Flags().IntSliceVar(&runAfter, "after", nil, "Only run the task once these task IDs have finished successfully")
+	runCmd.Flags().StringP("group", "g", "", "Run the task in this group, limited by the group's parallelism")
+	Viper.BindPFlag("run.group", runCmd.Flags().Lookup("group"))
+	// --group is taken by task groups, so this isn't called --group as in GNU parallel.
+	runCmd.Flags().Bool("group-output", false, "Buffer the task's output, and write it all at once when the task exits")
+	Viper.BindPFlag("run.group_output", runCmd.Flags().Lookup("group-output"))
+	runCmd.Flags().BoolP("keep-order", "k", false, "As --group-output, but write the output after that of every task submitted earlier with --keep-order in the same group")
+	Viper.BindPFlag("run.keep_order", runCmd.Flags().Lookup("keep-order"))
+	runCmd.Flags().Bool("tag", false, "Start each line of the task's output with its arguments and a tab")
+	Viper.BindPFlag("run.tag", runCmd.Flags().Lookup("tag"))
+	runCmd.Flags().String("line-prefix", "", "Start each line of the task's output with this, after replacing placeholders such as {id} and {arg1}")
+	Viper.BindPFlag("run.line_prefix", runCmd.Flags().Lookup("line-prefix"))
+	runCmd.Flags().Bool("timestamp", false, "Start each line of the task's output with the time it was written")
+	Viper.BindPFlag("run.timestamp", runCmd.Flags().Lookup("timestamp"))
+	runCmd.Flags().Bool("color", false, "Color each task's line prefix differently")
+	Viper.BindPFlag("run.color", runCmd.Flags().Lookup("color"))
+	runCmd.Flags().String("stdin", "", "Have the server open this file as the task's stdin when it starts")
+	Viper.BindPFlag("run.stdin", runCmd.Flags().Lookup("stdin"))
+	runCmd.Flags().String("stdout", "", "Have the server create this file as the task's stdout when it starts")
+	Viper.BindPFlag("run.stdout", runCmd.Flags().Lookup("stdout"))
+	runCmd.Flags().String("stderr", "", "Have the server create this file as the task's stderr when it starts")
+	Viper.BindPFlag("run.stderr", runCmd.Flags().Lookup("stderr"))
 }
@@ -18,7 +18,9 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/akramer/lateral/client"
 	"github.com/akramer/lateral/platform"
@@ -29,6 +31,25 @@ import (
 
 const MAGICENV = "LAT_MAGIC"
 
+// Extra arguments for the forked server, overriding those it was given.
+var forkArgs []string
+
+// The forked server runs in /, so make the path in the given flag absolute,
+// for this process and the server.
+func absPathFlag(flag, key string) error {
+	p := Viper.GetString(key)
+	if p == "" || filepath.IsAbs(p) {
+		return nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	Viper.Set(key, abs)
+	forkArgs = append(forkArgs, "--"+flag+"="+abs)
+	return nil
+}
+
 // Make the socket directory, if it does not yet exist.
 func makeSocketDir(socket string) error {
 	dir := path.Dir(socket)
@@ -73,7 +94,7 @@ func forkMyself() error {
 		Dir:   "/",
 		Env:   os.Environ(),
 		Files: []uintptr{0, 1, 2}}
-	_, err = syscall.ForkExec(exe, os.Args, attr)
+	_, err = syscall.ForkExec(exe, append(os.Args, forkArgs...), attr)
 	return err
 }
 
@@ -89,6 +110,27 @@ func isRunning() bool {
 }
 
 func runStart(cmd *cobra.Command, args []string) {
+	if err := server.ValidateHaltPolicy(Viper.GetString("start.halt")); err != nil {
+		panic(err)
+	}
+	if err := absPathFlag("joblog", "start.joblog"); err != nil {
+		panic(fmt.Errorf("Invalid job log path: %v", err))
+	}
+	if err := absPathFlag("resume", "start.resume"); err != nil {
+		panic(fmt.Errorf("Invalid resume job log path: %v", err))
+	}
+	if path := Viper.GetString("start.resume"); path != "" {
+		if _, err := server.ReadJoblog(path); err != nil {
+			panic(fmt.Errorf("Error reading job log to resume: %v", err))
+		}
+	}
+	if path := Viper.GetString("start.joblog"); path != "" {
+		j, err := server.OpenJoblog(path, Viper.GetBool("start.joblog_usage"))
+		if err != nil {
+			panic(fmt.Errorf("Error opening job log: %v", err))
+		}
+		j.Close()
+	}
 	// If MAGICENV is set to the socket path, we can be (relatively) sure we're the child process.
 	if Viper.GetBool("start.foreground") || os.Getenv(MAGICENV) == Viper.GetString("socket") {
 		glog.Infoln("Not forking a child server")
@@ -130,6 +172,36 @@ func init() {
 	Viper.BindPFlag("start.foreground", startCmd.Flags().Lookup("foreground"))
 	startCmd.Flags().IntP("parallel", "p", 10, "Number of concurrent tasks to run")
 	Viper.BindPFlag("start.parallel", startCmd.Flags().Lookup("parallel"))
+	startCmd.Flags().Duration("timeout", 0, "Default time a task may run before it is sent SIGTERM. 0 means no limit.")
+	Viper.BindPFlag("start.timeout", startCmd.Flags().Lookup("timeout"))
+	startCmd.Flags().Duration("kill-after", 10*time.Second, "Default time between SIGTERM and SIGKILL for a task that timed out")
+	Viper.BindPFlag("start.kill_after", startCmd.Flags().Lookup("kill-after"))
+	startCmd.Flags().Duration("aging", time.Minute, "Raise a pending task's priority by one for each interval it waits. 0 disables aging.")
+	Viper.BindPFlag("start.aging", startCmd.Flags().Lookup("aging"))
+	startCmd.Flags().String("halt", "never", "When to stop running tasks, as never or now|soon,fail=N|fail=P%|success=N. soon stops starting new tasks, now also terminates running ones. P% is of the tasks submitted so far, and applies once 3 have finished.")
+	Viper.BindPFlag("start.halt", startCmd.Flags().Lookup("halt"))
+	startCmd.Flags().Int("keep-finished", 0, "Forget the oldest finished tasks beyond this many. 0 keeps them all.")
+	Viper.BindPFlag("start.keep_finished", startCmd.Flags().Lookup("keep-finished"))
+	startCmd.Flags().Duration("keep-finished-for", 0, "Forget finished tasks this long after they finish. 0 keeps them forever.")
+	Viper.BindPFlag("start.keep_finished_for", startCmd.Flags().Lookup("keep-finished-for"))
+	startCmd.Flags().String("joblog", "", "Append a line for each finished task to this file, in the format of GNU parallel's --joblog")
+	Viper.BindPFlag("start.joblog", startCmd.Flags().Lookup("joblog"))
+	startCmd.Flags().Bool("joblog-usage", false, "Add resource usage columns to the job log, before the command")
+	Viper.BindPFlag("start.joblog_usage", startCmd.Flags().Lookup("joblog-usage"))
+	startCmd.Flags().Int("spill-after", 1<<20, "Bytes of a task's buffered output to keep in memory before spilling to a temporary file")
+	Viper.BindPFlag("start.spill_after", startCmd.Flags().Lookup("spill-after"))
+	startCmd.Flags().Int("buffer-max", 64<<20, "Total bytes of all tasks' buffered output to keep in memory before spilling to temporary files. 0 means no limit.")
+	Viper.BindPFlag("start.buffer_max", startCmd.Flags().Lookup("buffer-max"))
+	startCmd.Flags().Bool("spool", false, "Keep a copy of each task's output next to the socket, for lateral logs. Output that goes to a terminal isn't kept, so that tasks still see the terminal, unless it is captured with --tag, --group-output and the like")
+	Viper.BindPFlag("start.spool", startCmd.Flags().Lookup("spool"))
+	startCmd.Flags().Int("spool-task-max", 10<<20, "Bytes of each task's output to keep with --spool")
+	Viper.BindPFlag("start.spool_task_max", startCmd.Flags().Lookup("spool-task-max"))
+	startCmd.Flags().Int("spool-max", 1<<30, "Total bytes of output to keep with --spool, removing the oldest tasks' output first")
+	Viper.BindPFlag("start.spool_max", startCmd.Flags().Lookup("spool-max"))
+	startCmd.Flags().String("resume", "", "Don't run tasks whose command is already in this job log, which may be the same as --joblog")
+	Viper.BindPFlag("start.resume", startCmd.Flags().Lookup("resume"))
+	startCmd.Flags().Bool("resume-failed", false, "With --resume, run tasks whose command failed in the job log again")
+	Viper.BindPFlag("start.resume_failed", startCmd.Flags().Lookup("resume-failed"))
 
 	// glog flags
 	startCmd.PersistentFlags().Bool("logtostderr", false, "log to standard error instead of files")
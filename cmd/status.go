@@ -0,0 +1,176 @@
+// Copyright © 2016 Adam Kramer <akramer@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/akramer/lateral/client"
+	"github.com/akramer/lateral/server"
+	"github.com/spf13/cobra"
+)
+
+var statusPending, statusRunning, statusFinished, statusUsage bool
+var statusGroup string
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.Stamp)
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Returns tab separated resource usage columns for t.
+func formatUsage(t *server.TaskStatus) string {
+	if len(t.Attempts) == 0 || t.State != server.TASK_FINISHED {
+		return "-\t-\t-\t-\t-\t-\t-\t-"
+	}
+	u := t.Usage
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d", formatDuration(u.Wall), formatDuration(u.User),
+		formatDuration(u.System), formatBytes(u.MaxRSS), u.InBlock, u.OutBlock, u.VoluntaryCtxSw, u.InvoluntaryCtxSw)
+}
+
+func formatExit(t *server.TaskStatus) string {
+	if t.State != server.TASK_FINISHED {
+		return "-"
+	}
+	if t.Skipped != "" {
+		return "skipped (" + t.Skipped + ")"
+	}
+	if t.Resumed != "" {
+		return "resumed (" + t.Resumed + ")"
+	}
+	if t.Cancelled && t.Pid == 0 {
+		return "cancelled"
+	}
+	if t.StartError != "" {
+		return "failed to start (" + t.StartError + ")"
+	}
+	var exit string
+	if t.Signal != 0 {
+		exit = syscall.Signal(t.Signal).String()
+	} else {
+		exit = fmt.Sprintf("%d", t.ExitStatus)
+	}
+	if t.TimedOut {
+		exit += " (timed out)"
+	} else if t.Cancelled {
+		exit += " (cancelled)"
+	}
+	return exit
+}
+
+func runStatusCmd(cmd *cobra.Command, args []string) {
+	status := &server.RequestStatus{Group: statusGroup}
+	if statusPending {
+		status.States = append(status.States, server.TASK_PENDING)
+	}
+	if statusRunning {
+		status.States = append(status.States, server.TASK_RUNNING, server.TASK_FLUSHING)
+	}
+	if statusFinished {
+		status.States = append(status.States, server.TASK_FINISHED)
+	}
+	c, err := client.NewUnixConn(Viper)
+	if err != nil {
+		panic(fmt.Errorf("Error connecting to server: %v", err))
+	}
+	defer c.Close()
+	req := &server.Request{
+		Type:   server.REQUEST_STATUS,
+		Status: status,
+	}
+	err = client.SendRequest(c, req)
+	if err != nil {
+		panic(fmt.Errorf("Error sending request: %v", err))
+	}
+	resp, err := client.ReceiveResponse(c)
+	if err != nil {
+		panic(fmt.Errorf("Error receiving response: %v", err))
+	}
+	if resp.Type != server.RESPONSE_STATUS {
+		panic(fmt.Errorf("Error in server response: %v", resp.Message))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	usage := ""
+	if statusUsage {
+		usage = "WALL\tUSER\tSYS\tMAXRSS\tINBLK\tOUTBLK\tVCSW\tIVCSW\t"
+	}
+	fmt.Fprintln(w, "ID\tGROUP\tSTATE\tPRI\tPID\tSUBMITTED\tSTARTED\tENDED\tEXIT\tTRIES\t"+usage+"CWD\tCOMMAND")
+	for n := range resp.Status.Tasks {
+		t := &resp.Status.Tasks[n]
+		pid := "-"
+		if t.Pid != 0 {
+			pid = fmt.Sprintf("%d", t.Pid)
+		}
+		group := t.Group
+		if group == "" {
+			group = "-"
+		}
+		usage := ""
+		if statusUsage {
+			usage = formatUsage(t) + "\t"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%v\t%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s%s\t%s\n", t.Id, group, t.State, t.Priority, pid,
+			formatTime(t.Submitted), formatTime(t.Started), formatTime(t.Ended),
+			formatExit(t), len(t.Attempts), usage, t.Cwd, strings.Join(t.Args, " "))
+	}
+	w.Flush()
+}
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List the server's pending, running and finished tasks",
+	Long: `List the tasks known to the server, along with their state, pid, timing and exit status.
+By default all tasks are listed. Passing any of --pending, --running or --finished
+restricts the list to tasks in those states. With --usage, the resources used by
+each finished task's last attempt are listed too: wall-clock, user and system
+time, peak resident set size, blocks read and written, and voluntary and
+involuntary context switches.`,
+	Run: runStatusCmd,
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().BoolVar(&statusPending, "pending", false, "List pending tasks")
+	statusCmd.Flags().BoolVar(&statusRunning, "running", false, "List running tasks, including those whose output is still being written")
+	statusCmd.Flags().BoolVar(&statusFinished, "finished", false, "List finished tasks")
+	statusCmd.Flags().StringVarP(&statusGroup, "group", "g", "", "Only list tasks in this group")
+	statusCmd.Flags().BoolVarP(&statusUsage, "usage", "u", false, "List the resources used by finished tasks")
+}
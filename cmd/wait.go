@@ -16,6 +16,9 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/akramer/lateral/client"
 	"github.com/akramer/lateral/server"
@@ -24,11 +27,59 @@ import (
 
 // waitCmd represents the wait command
 var waitCmd = &cobra.Command{
-	Use:   "wait",
+	Use:   "wait [<id>...]",
 	Short: "Wait for all currently inserted tasks to finish",
-	Long: `Wait for all currently inserted tasks to finish.
-Returns 0 if all tasks exited with success, otherwise returns 1.`,
+	Long: `Wait for all currently inserted tasks to finish, then shut down the server.
+
+Tasks submitted after wait starts aren't waited for, unless --drain is given,
+in which case wait returns only once no tasks are pending or running. When
+wait shuts down the server, pending tasks are cancelled.
+
+Returns 0 if all tasks exited with success, 4 if the server halted because of
+its --halt policy, 3 if any task was stopped for exceeding its timeout, and
+otherwise 1. Tasks that were skipped count as failures unless --skipped=ignore
+is given. Cancelled tasks don't count as failures.
+
+--exit-policy changes how the exit status is computed from the failed tasks:
+  any    the default, described above
+  all    1 only if every task failed
+  max    the highest exit status of any task
+  first  the exit status of the first task to fail
+  count  the number of failed tasks, up to 125
+A task's exit status is its exit code, 128 plus the number of the signal that
+killed it, 127 if it couldn't be started, or 1 if it was skipped. Only any and
+all can be combined with --any or --timeout, whose own exit statuses would
+otherwise be indistinguishable from a task's.
+
+Given task IDs, only those tasks are waited for, and each one's exit status is
+printed. With --group, only tasks in that group are waited for. Either way,
+the server is left running.
+
+With --any, wait returns as soon as one task finishes that no earlier
+'wait --any' has reported, prints its exit status, and leaves the server
+running. The exit status is computed from that task alone, or is 5 if there
+are no tasks left to report. Only tasks of the current epoch that haven't been
+forgotten are reported. This makes it easy to process results in a loop as they
+complete.
+
+With --timeout, wait gives up and returns 124 if the tasks haven't finished in
+time. The server is left running.
+
+Waits only report on tasks submitted in the current epoch. With --reset, wait
+starts a new epoch once it has reported, also clearing any halt, and leaves the
+server running for the next batch of tasks.
+
+With --summary, the resources used by the tasks are printed too, including
+how many tasks and CPUs were busy on average, which helps choose -p.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		var ids []int
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				panic(fmt.Errorf("Invalid task ID %q", arg))
+			}
+			ids = append(ids, id)
+		}
 		c, err := client.NewUnixConn(Viper)
 		if err != nil {
 			panic(fmt.Errorf("Error connecting to server: %v", err))
@@ -36,6 +87,16 @@ Returns 0 if all tasks exited with success, otherwise returns 1.`,
 		defer c.Close()
 		req := &server.Request{
 			Type: server.REQUEST_WAIT,
+			Wait: &server.RequestWait{
+				Skipped:    Viper.GetString("wait.skipped"),
+				Group:      Viper.GetString("wait.group"),
+				Ids:        ids,
+				ExitPolicy: Viper.GetString("wait.exit_policy"),
+				Any:        Viper.GetBool("wait.any"),
+				Timeout:    Viper.GetDuration("wait.timeout"),
+				Drain:      Viper.GetBool("wait.drain"),
+				Reset:      Viper.GetBool("wait.reset"),
+			},
 		}
 		err = client.SendRequest(c, req)
 		if err != nil {
@@ -49,8 +110,42 @@ Returns 0 if all tasks exited with success, otherwise returns 1.`,
 			panic(fmt.Errorf("Error in server response: %v", resp.Message))
 		}
 		ExitCode = resp.Wait.ExitStatus
+		if resp.Wait.Expired {
+			fmt.Fprintln(os.Stderr, "Timed out waiting for tasks")
+			return
+		}
+		if Viper.GetBool("wait.any") && len(resp.Wait.Tasks) == 0 {
+			fmt.Fprintln(os.Stderr, "No tasks left to wait for")
+			return
+		}
+		for n := range resp.Wait.Tasks {
+			t := &resp.Wait.Tasks[n]
+			fmt.Printf("%d\t%s\n", t.Id, formatExit(t))
+		}
+		for _, f := range resp.Wait.StartFailures {
+			fmt.Fprintf(os.Stderr, "Task %d failed to start: %s\n", f.Id, f.Error)
+		}
+		if resp.Wait.Halted != "" {
+			fmt.Fprintf(os.Stderr, "Server %s\n", resp.Wait.Halted)
+		}
+		if resp.Wait.TimedOut > 0 {
+			fmt.Fprintf(os.Stderr, "%d task(s) timed out\n", resp.Wait.TimedOut)
+		}
+		if resp.Wait.Cancelled > 0 {
+			fmt.Fprintf(os.Stderr, "%d task(s) cancelled\n", resp.Wait.Cancelled)
+		}
+		if resp.Wait.Skipped > 0 {
+			fmt.Fprintf(os.Stderr, "%d task(s) skipped\n", resp.Wait.Skipped)
+		}
+		if resp.Wait.Resumed > 0 {
+			fmt.Fprintf(os.Stderr, "%d task(s) already done in the resumed job log\n", resp.Wait.Resumed)
+		}
+		if Viper.GetBool("wait.summary") {
+			printSummary(resp.Wait)
+		}
 
-		if Viper.GetBool("wait.no_shutdown") {
+		// Other tasks may still have work to do.
+		if Viper.GetBool("wait.no_shutdown") || Viper.GetString("wait.group") != "" || len(ids) > 0 || Viper.GetBool("wait.any") || Viper.GetBool("wait.reset") {
 			return
 		}
 
@@ -72,8 +167,46 @@ Returns 0 if all tasks exited with success, otherwise returns 1.`,
 	},
 }
 
+// Print the resources used by the tasks waited for to stderr.
+func printSummary(w *server.ResponseWait) {
+	u := w.Usage
+	fmt.Fprintf(os.Stderr, "%d task(s) ran in %s\n", w.Ran, formatDuration(w.Elapsed))
+	if w.Ran == 0 {
+		return
+	}
+	cpu := u.User + u.System
+	// Usage adds up every attempt, so retried tasks count more than once.
+	fmt.Fprintf(os.Stderr, "Wall time, including retries: %s total, %s per task\n", formatDuration(u.Wall), formatDuration(u.Wall/time.Duration(w.Ran)))
+	fmt.Fprintf(os.Stderr, "CPU time, including retries: %s user, %s system, %s per task\n", formatDuration(u.User), formatDuration(u.System),
+		formatDuration(cpu/time.Duration(w.Ran)))
+	if w.Elapsed > 0 {
+		// How many tasks and CPUs were busy on average, to compare with -p.
+		fmt.Fprintf(os.Stderr, "Average concurrency, including retries: %.1f tasks, %.1f CPUs\n",
+			u.Wall.Seconds()/w.Elapsed.Seconds(), cpu.Seconds()/w.Elapsed.Seconds())
+	}
+	fmt.Fprintf(os.Stderr, "Peak RSS of a task: %s\n", formatBytes(u.MaxRSS))
+	fmt.Fprintf(os.Stderr, "Blocks read: %d, written: %d\n", u.InBlock, u.OutBlock)
+	fmt.Fprintf(os.Stderr, "Context switches: %d voluntary, %d involuntary\n", u.VoluntaryCtxSw, u.InvoluntaryCtxSw)
+}
+
 func init() {
 	RootCmd.AddCommand(waitCmd)
 	waitCmd.Flags().BoolP("no_shutdown", "n", false, "Do not shut down server after wait is complete")
 	Viper.BindPFlag("wait.no_shutdown", waitCmd.Flags().Lookup("no_shutdown"))
+	waitCmd.Flags().String("skipped", "fail", "How skipped tasks count toward the exit status: fail or ignore")
+	Viper.BindPFlag("wait.skipped", waitCmd.Flags().Lookup("skipped"))
+	waitCmd.Flags().StringP("group", "g", "", "Only wait for tasks in this group")
+	Viper.BindPFlag("wait.group", waitCmd.Flags().Lookup("group"))
+	waitCmd.Flags().String("exit-policy", "any", "How the exit status is computed: any, all, max, first or count")
+	Viper.BindPFlag("wait.exit_policy", waitCmd.Flags().Lookup("exit-policy"))
+	waitCmd.Flags().Bool("any", false, "Wait for the next task to finish that hasn't already been reported")
+	Viper.BindPFlag("wait.any", waitCmd.Flags().Lookup("any"))
+	waitCmd.Flags().Duration("timeout", 0, "Give up waiting after this long")
+	Viper.BindPFlag("wait.timeout", waitCmd.Flags().Lookup("timeout"))
+	waitCmd.Flags().Bool("drain", false, "Also wait for tasks submitted after wait starts")
+	Viper.BindPFlag("wait.drain", waitCmd.Flags().Lookup("drain"))
+	waitCmd.Flags().Bool("reset", false, "Start a new epoch after reporting, and leave the server running")
+	Viper.BindPFlag("wait.reset", waitCmd.Flags().Lookup("reset"))
+	waitCmd.Flags().Bool("summary", false, "Print the resources used by the tasks")
+	Viper.BindPFlag("wait.summary", waitCmd.Flags().Lookup("summary"))
 }
@@ -5,8 +5,12 @@ package platform
 import (
 	"fmt"
 	"os"
+	"syscall"
 )
 
+// The ioctl that gets a terminal's attributes
+const ioctlGetTermios = syscall.TIOCGETA
+
 func Getexe() (string, error) {
 	pid := os.Getpid()
 	return fmt.Sprintf("/proc/%d/file", pid), nil
@@ -2,6 +2,11 @@
 
 package platform
 
+import "syscall"
+
+// The ioctl that gets a terminal's attributes
+const ioctlGetTermios = syscall.TCGETS
+
 func Getexe() (string, error) {
 	return "/proc/self/exe", nil
 }
@@ -1,6 +1,9 @@
 package platform
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 // Getsid implements the missing half of Setsid in syscall
 func Getsid(pid int) (sid int, err error) {
@@ -22,6 +25,23 @@ func Getfd(fd int) (cloexec bool, err error) {
 	return
 }
 
+// DupCloexec duplicates fd, setting close on exec on the new filedescriptor
+func DupCloexec(fd int) (nfd int, err error) {
+	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_DUPFD_CLOEXEC, 0)
+	nfd = int(r0)
+	if e1 != 0 {
+		err = e1
+	}
+	return
+}
+
+// IsTerminal returns true if fd is a terminal
+func IsTerminal(fd int) bool {
+	var termios syscall.Termios
+	_, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlGetTermios, uintptr(unsafe.Pointer(&termios)))
+	return e1 == 0
+}
+
 // Stat performs a stat without creating an os.File that has close-on-garbage-collect semantics
 func stat(fd int) (*syscall.Stat_t, error) {
 	var stat syscall.Stat_t
@@ -0,0 +1,81 @@
+package server
+
+import "time"
+
+// A named set of tasks with its own queue and, optionally, its own limit on
+// how many of them run at once. Group limits are nested under the server's
+// global parallelism: a task needs a free slot in both to start.
+type group struct {
+	name string
+	// Maximum number of running tasks in the group, or -1 for no limit
+	// beyond the global one.
+	parallel int
+	// Number of tasks in each state, as in instance.
+	pending  int
+	running  int
+	flushing int
+	// Pending tasks that are ready to run, in dispatch order
+	queue *taskQueue
+	// Created when the first task whose output is kept in order is submitted
+	order *orderer
+}
+
+// Returns the named group, creating it without a limit if it doesn't exist.
+// Must be called with i.m held.
+func (i *instance) group(name string) *group {
+	g := i.groups[name]
+	if g == nil {
+		g = &group{
+			name:     name,
+			parallel: -1,
+			queue:    newTaskQueue(),
+		}
+		i.groups[name] = g
+	}
+	return g
+}
+
+// Forget g if it has no limit of its own and no unfinished tasks, so that
+// groups used once don't accumulate. It is created again if it is needed.
+// Must be called with i.m held.
+func (i *instance) releaseGroup(g *group) {
+	if g.parallel < 0 && g.pending == 0 && g.running == 0 && g.flushing == 0 && i.groups[g.name] == g {
+		delete(i.groups, g.name)
+	}
+}
+
+// Whether the group's limit allows another task to start.
+func (g *group) hasSlot() bool {
+	return g.parallel < 0 || g.running < g.parallel
+}
+
+// Queue a pending task that is ready to run, and let the broker know.
+// Must be called with i.m held.
+func (i *instance) enqueue(t *task) {
+	t.group.queue.push(t)
+	i.slotAvailable.Signal()
+}
+
+// Remove and return the next task to dispatch across all groups with a free
+// slot, or nil if there is none. Must be called with i.m held.
+func (i *instance) nextTask(now time.Time) *task {
+	aging := i.viper.GetDuration("start.aging")
+	var best *task
+	var bestPriority int
+	for _, g := range i.groups {
+		if !g.hasSlot() {
+			continue
+		}
+		t, priority := g.queue.peek(now, aging)
+		if t == nil {
+			continue
+		}
+		if best == nil || priority > bestPriority || (priority == bestPriority && t.id < best.id) {
+			best, bestPriority = t, priority
+		}
+	}
+	if best != nil {
+		best.group.queue.remove(best)
+	}
+	return best
+}
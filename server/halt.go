@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// When to stop running tasks, modelled on GNU parallel's --halt.
+type haltPolicy struct {
+	// Also terminate running tasks, rather than only stopping dispatch.
+	now bool
+	// Count successes rather than failures.
+	success bool
+	// Halt once this many tasks have failed (or succeeded)...
+	count int
+	// ...or, if non-zero, this percentage of the tasks submitted in the
+	// epoch so far.
+	percent float64
+}
+
+// Tasks are submitted one at a time, so early on a single failure can be a
+// large percentage of them. As in GNU parallel, percentages only count once
+// this many tasks have finished.
+const haltMinFinished = 3
+
+// Parse a halt policy such as "now,fail=1", "soon,fail=10%" or
+// "soon,success=3". "never" or "" returns nil.
+func parseHaltPolicy(s string) (*haltPolicy, error) {
+	if s == "" || s == "never" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Halt policy %q should look like now|soon,fail=N|fail=P%%|success=N", s)
+	}
+	h := &haltPolicy{}
+	switch parts[0] {
+	case "now":
+		h.now = true
+	case "soon":
+	default:
+		return nil, fmt.Errorf("Halt policy %q should start with now or soon", s)
+	}
+	kv := strings.SplitN(parts[1], "=", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("Halt policy %q is missing a condition", s)
+	}
+	switch kv[0] {
+	case "fail":
+	case "success":
+		h.success = true
+	default:
+		return nil, fmt.Errorf("Halt policy %q should halt on fail or success", s)
+	}
+	if strings.HasSuffix(kv[1], "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(kv[1], "%"), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("Invalid percentage in halt policy %q", s)
+		}
+		h.percent = p
+	} else {
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid count in halt policy %q", s)
+		}
+		h.count = n
+	}
+	return h, nil
+}
+
+// ValidateHaltPolicy returns an error if s isn't a valid halt policy.
+func ValidateHaltPolicy(s string) error {
+	_, err := parseHaltPolicy(s)
+	return err
+}
+
+// Whether the policy is triggered by the given number of tasks having
+// finished in the way the policy counts, given how many tasks of the epoch
+// have finished and have been submitted.
+func (h *haltPolicy) triggered(n, finished, submitted int) bool {
+	if h.percent > 0 {
+		return finished >= haltMinFinished && float64(n)*100 >= h.percent*float64(submitted)
+	}
+	return n >= h.count
+}
+
+// Check whether the just-finished t causes the server to halt, and if so,
+// halt it. Must be called with i.m held.
+func (i *instance) checkHalt(t *task) {
+	// Stragglers from earlier epochs don't count.
+	if t.id < i.epochStart {
+		return
+	}
+	if t.succeeded() {
+		i.succeeded++
+	} else {
+		i.failed++
+	}
+	if i.halt == nil || i.halted != "" {
+		return
+	}
+	n, what := i.failed, "failed"
+	if i.halt.success {
+		n, what = i.succeeded, "succeeded"
+	}
+	if !i.halt.triggered(n, i.succeeded+i.failed, i.lastId-i.epochStart+1) {
+		return
+	}
+	i.halted = fmt.Sprintf("halted after task %d: %d task(s) %s", t.id, n, what)
+	glog.Infoln("Server", i.halted)
+	for _, p := range i.tasks {
+		if p.state == TASK_PENDING {
+			i.skip(p, "server "+i.halted)
+		} else if p.state == TASK_RUNNING && i.halt.now {
+			i.cancelRunning(p, syscall.SIGTERM)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Finished tasks are kept so that status and wait can report on them, but a
+// long-lived server can't keep them all. Waits report on the current epoch,
+// which starts when the server does and again each time a wait resets it.
+// Finished tasks beyond the start.keep_finished count, or older than
+// start.keep_finished_for, are forgotten. Those of the current epoch are
+// folded into a tally first, so waits stay accurate, but waits for any task no
+// longer report them. Nothing else about a
+// forgotten task is kept, so requests naming it by ID are rejected.
+
+// Summary of how a set of finished tasks ended.
+type tally struct {
+	failed    int
+	timedOut  int
+	skipped   int
+	cancelled int
+	resumed   int
+	// Number of tasks that ran, successfully or not
+	ran int
+	// Highest exit code of a task that ran
+	maxCode int
+	// Position in finish order of the first task to fail and its exit code,
+	// and of the first task to be skipped. 0 if there are none.
+	firstFailed     int
+	firstFailedCode int
+	firstSkipped    int
+	// Total resources used by tasks that ran, and when the first of them
+	// started and the last one ended
+	usage   Usage
+	started time.Time
+	ended   time.Time
+}
+
+// Add the finished task t to the tally.
+func (y *tally) add(t *task) {
+	if t.skipped != "" {
+		y.skipped++
+		y.firstSkipped = earliest(y.firstSkipped, t.finishSeq)
+		return
+	} else if t.cancelled {
+		y.cancelled++
+		return
+	} else if t.resumed != "" {
+		y.resumed++
+		return
+	}
+	y.ran++
+	// Every attempt used resources.
+	for _, a := range t.attempts {
+		y.usage.Add(a.usage())
+	}
+	a := t.lastAttempt()
+	y.span(t.attempts[0].started, a.ended)
+	code := t.exitCode()
+	if code > y.maxCode {
+		y.maxCode = code
+	}
+	// Only the final attempt of a retried task counts.
+	if a.timedOut {
+		y.timedOut++
+	} else if !a.succeeded() {
+		y.failed++
+	} else {
+		return
+	}
+	if earliest(y.firstFailed, t.finishSeq) == t.finishSeq {
+		y.firstFailed, y.firstFailedCode = t.finishSeq, code
+	}
+}
+
+// Add everything in o to the tally.
+func (y *tally) merge(o *tally) {
+	y.failed += o.failed
+	y.timedOut += o.timedOut
+	y.skipped += o.skipped
+	y.cancelled += o.cancelled
+	y.resumed += o.resumed
+	y.ran += o.ran
+	y.usage.Add(o.usage)
+	if o.ran > 0 {
+		y.span(o.started, o.ended)
+	}
+	if o.maxCode > y.maxCode {
+		y.maxCode = o.maxCode
+	}
+	if o.firstFailed != 0 && earliest(y.firstFailed, o.firstFailed) == o.firstFailed {
+		y.firstFailed, y.firstFailedCode = o.firstFailed, o.firstFailedCode
+	}
+	y.firstSkipped = earliest(y.firstSkipped, o.firstSkipped)
+}
+
+// Widen the tally's time span to include started to ended.
+func (y *tally) span(started, ended time.Time) {
+	if y.started.IsZero() || started.Before(y.started) {
+		y.started = started
+	}
+	if ended.After(y.ended) {
+		y.ended = ended
+	}
+}
+
+// Returns the earlier of two finish positions, ignoring zeros.
+func earliest(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Identical environments of different tasks share one slice, which is
+// forgotten along with the last task using it.
+type sharedEnv struct {
+	env  []string
+	refs int
+}
+
+// Returns a slice equal to env, shared with any other task that has the same
+// environment. Must be called with i.m held.
+func (i *instance) internEnv(env []string) []string {
+	key := strings.Join(env, "\x00")
+	s := i.envs[key]
+	if s == nil {
+		s = &sharedEnv{env: env}
+		i.envs[key] = s
+	}
+	s.refs++
+	return s.env
+}
+
+// Release a slice returned by internEnv. Must be called with i.m held.
+func (i *instance) releaseEnv(env []string) {
+	key := strings.Join(env, "\x00")
+	if s := i.envs[key]; s != nil {
+		s.refs--
+		if s.refs == 0 {
+			delete(i.envs, key)
+		}
+	}
+}
+
+// Forget finished tasks beyond the configured limits, oldest first. Must be
+// called with i.m held.
+func (i *instance) prune(now time.Time) {
+	max := i.viper.GetInt("start.keep_finished")
+	age := i.viper.GetDuration("start.keep_finished_for")
+	n := 0
+	for ; n < len(i.finished); n++ {
+		t := i.finished[n]
+		if (max <= 0 || len(i.finished)-n <= max) && (age <= 0 || now.Sub(t.finishedAt) <= age) {
+			break
+		}
+		if t.id >= i.epochStart {
+			y := i.pruned[t.group.name]
+			if y == nil {
+				y = &tally{}
+				i.pruned[t.group.name] = y
+			}
+			y.add(t)
+		}
+		delete(i.tasks, t.id)
+		if t.unreported != nil {
+			i.unreported.Remove(t.unreported)
+			t.unreported = nil
+		}
+		i.releaseEnv(t.request.Run.Env)
+		i.finished[n] = nil
+	}
+	i.finished = i.finished[n:]
+}
+
+// Returns the task with the given ID, or an error saying why there is none.
+// Must be called with i.m held.
+func (i *instance) lookup(id int) (*task, error) {
+	if t := i.tasks[id]; t != nil {
+		return t, nil
+	} else if id > 0 && id <= i.lastId {
+		// Only finished tasks are ever deleted.
+		return nil, fmt.Errorf("Task %d has finished and been forgotten", id)
+	}
+	return nil, fmt.Errorf("No task with ID %d", id)
+}
+
+// Start a new epoch with the tasks submitted after lastId. Must be called with
+// i.m held.
+func (i *instance) resetEpoch(lastId int) {
+	i.epochStart = lastId + 1
+	// Waits for any task only report on the current epoch.
+	for e := i.unreported.Front(); e != nil; {
+		next := e.Next()
+		if t := e.Value.(*task); t.id < i.epochStart {
+			i.unreported.Remove(e)
+			t.unreported = nil
+		}
+		e = next
+	}
+	i.pruned = make(map[string]*tally)
+	i.halted = ""
+	i.succeeded = 0
+	i.failed = 0
+}
@@ -79,8 +79,10 @@ func TestRunConnection(t *testing.T) {
 	resp, err = client.ReceiveResponse(c)
 	if err != nil {
 		t.Fatal("got error", err)
-	} else if resp.Type == server.RESPONSE_ERR {
+	} else if resp.Type != server.RESPONSE_RUN {
 		t.Fatal("got error", resp.Message)
+	} else if resp.Run.Id != 1 {
+		t.Error("First task ID wasn't 1")
 	}
 
 	sdr := &server.Request{
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// The first line of a job log, in the format of GNU parallel's --joblog.
+const joblogHeader = "Seq\tHost\tStarttime\tJobRuntime\tSend\tReceive\tExitval\tSignal\tCommand\n"
+
+// The first line of a job log with resource usage columns, which go before
+// the command so it stays last.
+const joblogUsageHeader = "Seq\tHost\tStarttime\tJobRuntime\tSend\tReceive\tExitval\tSignal\t" +
+	"UserTime\tSystemTime\tMaxRSS\tInBlock\tOutBlock\tVolCtxSw\tInvolCtxSw\tCommand\n"
+
+// Returns the path of the keys file of the job log at path.
+func joblogKeysPath(path string) string {
+	return path + ".keys"
+}
+
+// Joblog is an open job log and its keys file. Lines of a job log only hold
+// the command line as it was submitted, as GNU parallel writes it. So that
+// --resume can tell apart the same command run with different executables or
+// in different directories, each line also gets a line in the keys file, with
+// the exit value, signal and resume key of the task, separated by tabs.
+type Joblog struct {
+	log  *os.File
+	keys *os.File
+}
+
+// OpenJoblog opens the job log at path and its keys file for appending,
+// creating both with a header line if the job log doesn't exist or is empty.
+// A job log that was started without a keys file, for example by GNU
+// parallel, is continued without one. If usage is set, the header includes
+// resource usage columns.
+func OpenJoblog(path string, usage bool) (*Joblog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	j := &Joblog{log: f}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		header := joblogHeader
+		if usage {
+			header = joblogUsageHeader
+		}
+		_, err = f.WriteString(header)
+		if err == nil {
+			j.keys, err = os.OpenFile(joblogKeysPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0666)
+		}
+	} else if err == nil {
+		j.keys, err = os.OpenFile(joblogKeysPath(path), os.O_WRONLY|os.O_APPEND, 0666)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Close closes the job log and its keys file.
+func (j *Joblog) Close() {
+	j.log.Close()
+	if j.keys != nil {
+		j.keys.Close()
+	}
+}
+
+// Append a line for the finished task t to the job log, if there is one.
+// Tasks that never ran aren't logged, unless that was because of the job log
+// given to --resume: they are logged as they ended there, so resuming from
+// the new job log remembers them. The line is written in the background.
+// Must be called with i.m held.
+func (i *instance) logJob(t *task) {
+	a := t.lastAttempt()
+	if i.joblog == nil || (a == nil && t.logged == nil) {
+		return
+	}
+	var s AttemptStatus
+	var exitval, signal int
+	var start, runtime float64
+	if a != nil {
+		s = a.status()
+		exitval, signal = s.ExitStatus, s.Signal
+		if signal != 0 {
+			exitval = 0
+		} else if a.ps == nil {
+			exitval = t.exitCode()
+		}
+		start = float64(a.started.UnixNano()) / 1e9
+		runtime = a.ended.Sub(a.started).Seconds()
+	} else {
+		exitval, signal = t.logged.exitval, t.logged.signal
+		start = float64(t.finishedAt.UnixNano()) / 1e9
+	}
+	line := fmt.Sprintf("%d\t:\t%.3f\t%.3f\t0\t0\t%d\t%d\t", t.id, start, runtime, exitval, signal)
+	if i.viper.GetBool("start.joblog_usage") {
+		u := s.Usage
+		line += fmt.Sprintf("%.3f\t%.3f\t%d\t%d\t%d\t%d\t%d\t", u.User.Seconds(), u.System.Seconds(),
+			u.MaxRSS, u.InBlock, u.OutBlock, u.VoluntaryCtxSw, u.InvoluntaryCtxSw)
+	}
+	line += commandLine(t.request.Run) + "\n"
+	key := fmt.Sprintf("%d\t%d\t%s\n", exitval, signal, resumeKey(t.request.Run))
+	j := i.joblog
+	i.work.add(func() {
+		if _, err := j.log.WriteString(line); err != nil {
+			glog.Errorln("Error writing to job log:", err)
+		} else if j.keys == nil {
+			return
+		} else if _, err := j.keys.WriteString(key); err != nil {
+			glog.Errorln("Error writing to job log keys:", err)
+		}
+	})
+}
+
+// Returns the command line of r as it was submitted, as a shell command.
+func commandLine(r *RequestRun) string {
+	words := make([]string, len(r.Args))
+	for n, arg := range r.Args {
+		words[n] = shellQuote(arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// Returns the key --resume identifies r by, as a shell command that runs its
+// executable in its working directory.
+func resumeKey(r *RequestRun) string {
+	words := []string{"cd", shellQuote(r.Cwd), "&&", shellQuote(r.Exe)}
+	for n, arg := range r.Args {
+		// Args[0] is replaced by the executable.
+		if n > 0 {
+			words = append(words, shellQuote(arg))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quote s so a shell reads it as a single word. Newlines are written as
+// $'\n', which bash and zsh understand, so the word stays on one line.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	s = "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	return strings.Replace(s, "\n", `'$'\n''`, -1)
+}
+
+// How the last run of a command in a job log ended
+type jobResult struct {
+	exitval int
+	signal  int
+}
+
+func (r *jobResult) succeeded() bool {
+	return r.exitval == 0 && r.signal == 0
+}
+
+// ResumeLog is what --resume reads from a job log: how the last run of each
+// command in it ended.
+type ResumeLog struct {
+	// Commands are identified by resume key, or by command line if the job
+	// log has no keys file, for example because GNU parallel wrote it.
+	byCommand bool
+	results   map[string]*jobResult
+}
+
+// ReadJoblog reads the job log at path, from its keys file if it has one. A
+// job log that doesn't exist yet is empty.
+func ReadJoblog(path string) (*ResumeLog, error) {
+	r := &ResumeLog{results: make(map[string]*jobResult)}
+	f, err := os.Open(joblogKeysPath(path))
+	if os.IsNotExist(err) {
+		r.byCommand = true
+		f, err = os.Open(path)
+	}
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<24)
+	// Keys files have the exit value, signal and key. Job logs have the
+	// command last, but there may be usage columns before it.
+	columns, exitval := 3, 0
+	if r.byCommand {
+		columns, exitval = 9, 6
+	}
+	for n := 1; s.Scan(); n++ {
+		if r.byCommand && n == 1 && strings.HasPrefix(s.Text(), "Seq\t") {
+			columns = len(strings.Split(s.Text(), "\t"))
+			continue
+		}
+		fields := strings.SplitN(s.Text(), "\t", columns)
+		if len(fields) != columns {
+			return nil, fmt.Errorf("%s:%d: expected %d fields, got %d", f.Name(), n, columns, len(fields))
+		}
+		res := &jobResult{}
+		if res.exitval, err = strconv.Atoi(fields[exitval]); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad exit value: %v", f.Name(), n, err)
+		}
+		if res.signal, err = strconv.Atoi(fields[exitval+1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad signal: %v", f.Name(), n, err)
+		}
+		r.results[fields[columns-1]] = res
+	}
+	return r, s.Err()
+}
+
+// Returns how the command of r last ended in the job log given to --resume,
+// if that means it shouldn't be run again, or nil. As with GNU parallel,
+// commands in the job log aren't run again, unless they failed and
+// start.resume_failed is set. Must be called with i.m held.
+func (i *instance) resumed(r *RequestRun) *jobResult {
+	if i.resume == nil {
+		return nil
+	}
+	key := resumeKey(r)
+	if i.resume.byCommand {
+		key = commandLine(r)
+	}
+	res := i.resume.results[key]
+	if res == nil || (!res.succeeded() && i.viper.GetBool("start.resume_failed")) {
+		return nil
+	}
+	return res
+}
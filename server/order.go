@@ -0,0 +1,136 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Tasks in the "keep" output mode run concurrently like any others, but their
+// output is written in the order they were submitted, as with parallel -k.
+// Each group is an ordering domain. A task's output is held until every
+// earlier keep-order task in its group has finished and had its output
+// written. Until then the task gives up its slot and stays in the flushing
+// state, so cancel leaves it alone and waits include the writing of its
+// output.
+
+// Keep-order tasks of one group whose output hasn't been written yet.
+type orderer struct {
+	m sync.Mutex
+	// *turn in submission order
+	queue *list.List
+	// The element of each task in queue, by ID
+	elems map[int]*list.Element
+}
+
+// A task's place in an orderer's queue
+type turn struct {
+	id int
+	// Closed once the task is at the front of the queue
+	front chan struct{}
+}
+
+func newOrderer() *orderer {
+	return &orderer{queue: list.New(), elems: make(map[int]*list.Element)}
+}
+
+func (o *orderer) add(id int) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	t := &turn{id: id, front: make(chan struct{})}
+	o.elems[id] = o.queue.PushBack(t)
+	if o.queue.Len() == 1 {
+		close(t.front)
+	}
+}
+
+// Block until every task added before id has been removed.
+func (o *orderer) waitTurn(id int) {
+	o.m.Lock()
+	e := o.elems[id]
+	o.m.Unlock()
+	if e != nil {
+		<-e.Value.(*turn).front
+	}
+}
+
+// Remove id from the queue, if it is there, and let the next task go if id
+// was at the front.
+func (o *orderer) remove(id int) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	e := o.elems[id]
+	if e == nil {
+		return
+	}
+	front := e == o.queue.Front()
+	o.queue.Remove(e)
+	delete(o.elems, id)
+	if next := o.queue.Front(); front && next != nil {
+		close(next.Value.(*turn).front)
+	}
+}
+
+// Returns the ordering domain of t, or nil if its output isn't kept in order.
+// Must be called with i.m held.
+func (i *instance) orderer(t *task) *orderer {
+	if t.request.Run.Output != "keep" {
+		return nil
+	}
+	if t.group.order == nil {
+		t.group.order = newOrderer()
+	}
+	return t.group.order
+}
+
+// Finish the keep-order task t, which has given up its slot, once its output
+// has been written after that of the earlier tasks in its group.
+func (i *instance) finishInOrder(t *task) {
+	i.m.Lock()
+	o := i.orderer(t)
+	i.m.Unlock()
+	o.waitTurn(t.id)
+	for _, c := range t.held {
+		c.flush()
+	}
+	t.held = nil
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.flushing--
+	t.group.flushing--
+	i.finish(t)
+	i.taskFinished.Broadcast()
+}
+
+// Memory shared by the output buffers of all tasks. Buffers that can't get
+// any more write the rest to disk.
+type budget struct {
+	left int64
+}
+
+// Take n bytes from the budget, if there are that many left.
+func (b *budget) take(n int) bool {
+	if b == nil {
+		return true
+	}
+	if atomic.AddInt64(&b.left, -int64(n)) >= 0 {
+		return true
+	}
+	atomic.AddInt64(&b.left, int64(n))
+	return false
+}
+
+// Return n bytes to the budget.
+func (b *budget) give(n int) {
+	if b != nil {
+		atomic.AddInt64(&b.left, int64(n))
+	}
+}
+
+// Returns the budget for buffered output, or nil if it is unlimited.
+func newBudget(max int) *budget {
+	if max <= 0 {
+		return nil
+	}
+	return &budget{left: int64(max)}
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/akramer/lateral/platform"
+	"github.com/golang/glog"
+)
+
+// Output modes for RequestRun.Output.
+var outputModes = map[string]bool{
+	"":      true,
+	"group": true,
+	"line":  true,
+	"keep":  true,
+}
+
+// A buffer that keeps the first limit bytes written to it in memory, as long
+// as they fit in its budget, and the rest in a temporary file.
+type spillBuffer struct {
+	limit  int
+	budget *budget
+	mem    bytes.Buffer
+	// nil until the memory limit is reached
+	file *os.File
+}
+
+func newSpillBuffer(limit int, budget *budget) *spillBuffer {
+	return &spillBuffer{limit: limit, budget: budget}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil {
+		if b.mem.Len()+len(p) <= b.limit && b.budget.take(len(p)) {
+			return b.mem.Write(p)
+		}
+		f, err := ioutil.TempFile("", "lateral-output")
+		if err != nil {
+			return 0, err
+		}
+		// The file only needs to live as long as the open fd.
+		os.Remove(f.Name())
+		b.file = f
+	}
+	return b.file.Write(p)
+}
+
+// Write everything in the buffer to w.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b.mem.Bytes())
+	if err != nil || b.file == nil {
+		return int64(n), err
+	}
+	if _, err = b.file.Seek(0, io.SeekStart); err != nil {
+		return int64(n), err
+	}
+	m, err := io.Copy(w, b.file)
+	return int64(n) + m, err
+}
+
+// Release the buffer's memory and file.
+func (b *spillBuffer) Close() {
+	b.budget.give(b.mem.Len())
+	b.mem = bytes.Buffer{}
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// Where a captured stream's output goes while the task runs.
+type sink interface {
+	io.Writer
+	// Write anything held back to the destination, once the task's pipe has
+	// been closed.
+	flush() error
+	// Release the sink's resources.
+	Close()
+}
+
+// Sink for the default output mode, used when the output is only captured to
+// be spooled.
+type directSink struct {
+	io.Writer
+}
+
+func (d directSink) flush() error { return nil }
+
+func (d directSink) Close() {}
+
+// Sink for the "group" output mode, which holds all output until the end.
+type groupSink struct {
+	*spillBuffer
+	dst  io.Writer
+	lock *dstLock
+}
+
+func (g *groupSink) flush() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	_, err := g.WriteTo(g.dst)
+	return err
+}
+
+func (g *groupSink) Close() {
+	g.spillBuffer.Close()
+	g.lock.release()
+}
+
+// Longest line the "line" output mode holds back waiting for a newline.
+const maxLine = 64 << 10
+
+// ANSI colors for line prefixes. Tasks cycle through them by ID.
+var prefixColors = []string{"31", "32", "33", "34", "35", "36"}
+
+// Sink for the "line" output mode, which writes each line as soon as it is
+// complete, after a prefix, holding the lock on its destination so lines from
+// different tasks aren't mixed up.
+type lineSink struct {
+	dst    io.Writer
+	lock   *dstLock
+	prefix string
+	color  string
+	// Add the time each line was read to the prefix
+	timestamp bool
+	// The last incomplete line
+	partial []byte
+}
+
+func (l *lineSink) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		nl := bytes.IndexByte(p, '\n')
+		if nl < 0 {
+			l.partial = append(l.partial, p...)
+			if len(l.partial) < maxLine {
+				return n, nil
+			}
+			// Too long to hold back: write it as a line of its own.
+			p = nil
+		} else {
+			l.partial = append(l.partial, p[:nl+1]...)
+			p = p[nl+1:]
+		}
+		if err := l.writeLine(); err != nil {
+			return n - len(p), err
+		}
+	}
+	return n, nil
+}
+
+// Write the prefix and the held back line, and forget the line.
+func (l *lineSink) writeLine() error {
+	prefix := l.prefix
+	if l.timestamp {
+		prefix = time.Now().Format("2006-01-02T15:04:05.000 ") + prefix
+	}
+	if l.color != "" {
+		prefix = "\x1b[" + l.color + "m" + prefix + "\x1b[0m"
+	}
+	line := append([]byte(prefix), l.partial...)
+	l.partial = l.partial[:0]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err := l.dst.Write(line)
+	return err
+}
+
+func (l *lineSink) flush() error {
+	if len(l.partial) == 0 {
+		return nil
+	}
+	return l.writeLine()
+}
+
+func (l *lineSink) Close() {
+	l.lock.release()
+}
+
+// A lock shared by the sinks of every task that writes to the same file, so
+// that their lines and groups don't interleave, however long they are.
+type dstLock struct {
+	sync.Mutex
+	locks *dstLocks
+	key   dstKey
+	// Number of sinks using the lock
+	refs int
+}
+
+// Identifies a file by device and inode.
+type dstKey struct {
+	dev uint64
+	ino uint64
+}
+
+// The locks of the files that sinks currently write to.
+type dstLocks struct {
+	m     sync.Mutex
+	locks map[dstKey]*dstLock
+}
+
+// Returns the lock for writing to f, which must be released once the sink is
+// done with it. A file that can't be identified gets a lock of its own.
+func (d *dstLocks) get(f *os.File) *dstLock {
+	info, err := f.Stat()
+	if err != nil {
+		return &dstLock{}
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return &dstLock{}
+	}
+	key := dstKey{uint64(st.Dev), uint64(st.Ino)}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.locks == nil {
+		d.locks = make(map[dstKey]*dstLock)
+	}
+	l := d.locks[key]
+	if l == nil {
+		l = &dstLock{locks: d, key: key}
+		d.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// Give up a sink's use of the lock.
+func (l *dstLock) release() {
+	if l.locks == nil {
+		return
+	}
+	l.locks.m.Lock()
+	defer l.locks.m.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(l.locks.locks, l.key)
+	}
+}
+
+// The captured stdout and stderr of one attempt at running a task. The task
+// writes to pipes, and the server copies what it reads from them to the fds
+// received with the task.
+type capture struct {
+	streams []*stream
+	wg      sync.WaitGroup
+	// Closed once the task's process has exited
+	exited chan struct{}
+	// How long the pipes are still read once nothing more comes from them
+	// after the process exits
+	grace time.Duration
+	// nil unless the output is spooled
+	spool *spoolWriter
+	// The output is written by finishInOrder rather than by finish
+	held bool
+}
+
+// One captured output stream.
+type stream struct {
+	fd int
+	// The read end of the task's pipe
+	r *os.File
+	// Where the output finally goes
+	dst  *os.File
+	sink sink
+}
+
+// Returns a sink for stream s of t, according to its output mode.
+func (i *instance) newSink(t *task, s *stream) sink {
+	r := t.request.Run
+	if r.Output == "" {
+		return directSink{s.dst}
+	} else if r.Output == "group" || r.Output == "keep" {
+		return &groupSink{
+			spillBuffer: newSpillBuffer(i.viper.GetInt("start.spill_after"), i.buffers),
+			dst:         s.dst,
+			lock:        i.dsts.get(s.dst),
+		}
+	}
+	l := &lineSink{
+		dst:       s.dst,
+		lock:      i.dsts.get(s.dst),
+		prefix:    expandTemplate(r.LinePrefix, t),
+		timestamp: r.Timestamp,
+	}
+	if r.Color {
+		l.color = prefixColors[t.id%len(prefixColors)]
+	}
+	return l
+}
+
+// Replace the task's stdout and stderr in files with pipes, according to its
+// output mode and whether it is spooled, and start copying from them. Returns
+// nil if output isn't captured.
+func (i *instance) captureOutput(t *task, files []*os.File) *capture {
+	spool := i.openSpool(t)
+	if t.request.Run.Output == "" && spool == nil {
+		return nil
+	}
+	c := &capture{spool: spool, exited: make(chan struct{}), grace: i.outputGrace}
+	if t.request.Run.Output == "keep" {
+		c.held = true
+		t.held = append(t.held, c)
+	}
+	for fd := 1; fd <= 2 && fd < len(files); fd++ {
+		if files[fd] == nil {
+			continue
+		}
+		// Output that is only captured to be spooled isn't if it goes to a
+		// terminal, so the task still sees one.
+		if t.request.Run.Output == "" && platform.IsTerminal(int(files[fd].Fd())) {
+			continue
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			glog.Errorf("Error capturing fd %d of task %d: %v", fd, t.id, err)
+			continue
+		}
+		s := &stream{
+			fd:  fd,
+			r:   r,
+			dst: files[fd],
+		}
+		s.sink = i.newSink(t, s)
+		files[fd] = w
+		c.streams = append(c.streams, s)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			var w io.Writer = s.sink
+			if c.spool != nil {
+				w = &teeWriter{sink: s.sink, spool: c.spool, fd: s.fd, id: t.id}
+			}
+			if err := c.copy(w, s.r); err != nil {
+				glog.Errorf("Error capturing fd %d of task %d: %v", s.fd, t.id, err)
+			}
+			s.r.Close()
+		}()
+	}
+	return c
+}
+
+// Copies a stream's output to its sink and to the spool. The spool gets all of
+// it even if the sink fails, in which case the error is logged once and the
+// sink gets no more.
+type teeWriter struct {
+	sink  sink
+	spool *spoolWriter
+	// The stream's fd and task ID, for logging
+	fd  int
+	id  int
+	err error
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		if _, w.err = w.sink.Write(p); w.err != nil {
+			glog.Errorf("Error capturing fd %d of task %d: %v", w.fd, w.id, w.err)
+		}
+	}
+	return w.spool.Write(p)
+}
+
+// Copy from r to w until r is closed, or until nothing has been read from r
+// for c.grace after the task's process exited.
+func (c *capture) copy(w io.Writer, r *os.File) error {
+	buf := make([]byte, 32<<10)
+	for {
+		select {
+		case <-c.exited:
+			// Writing to a slow destination doesn't use up the grace
+			// period, only waiting for more output does.
+			r.SetReadDeadline(time.Now().Add(c.grace))
+		default:
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Wait, once the task's process has exited, until everything that holds its
+// pipes open has exited too, or until nothing more has come from them for the
+// grace period, then write any output held back to its destinations, unless
+// it is held for finishInOrder. Children that the task left in the background
+// and that write later get EPIPE.
+func (c *capture) finish() {
+	for _, s := range c.streams {
+		// The copy may already be waiting for more output.
+		s.r.SetReadDeadline(time.Now().Add(c.grace))
+	}
+	close(c.exited)
+	c.wg.Wait()
+	if c.spool != nil {
+		c.spool.Close()
+	}
+	if !c.held {
+		c.flush()
+	}
+}
+
+// Write any output held back to its destinations.
+func (c *capture) flush() {
+	for _, s := range c.streams {
+		if err := s.sink.flush(); err != nil {
+			glog.Errorf("Error writing captured output to fd %d: %v", s.fd, err)
+		}
+		s.sink.Close()
+		s.dst.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"container/list"
+	"sort"
+	"time"
+)
+
+// The queue of tasks waiting for a slot. Tasks are dispatched highest
+// priority first, and in the order they became ready within a priority, which
+// is submission order unless they waited for dependencies or were
+// reprioritized. Retried tasks go first within their priority.
+//
+// With aging enabled, a task's effective priority rises by one for every
+// aging interval it has waited since submission, so a steady supply of high
+// priority work can't starve the rest of the queue.
+type taskQueue struct {
+	// One FIFO per priority. Empty FIFOs are removed.
+	levels map[int]*list.List
+	// The priorities in levels, highest first. Without aging, the next task
+	// is at the front of the first level. With aging, picking it costs one
+	// comparison per priority in use.
+	priorities []int
+	len        int
+}
+
+func newTaskQueue() *taskQueue {
+	return &taskQueue{levels: make(map[int]*list.List)}
+}
+
+func (q *taskQueue) Len() int {
+	return q.len
+}
+
+// Add t to the back of the queue at its priority.
+func (q *taskQueue) push(t *task) {
+	t.elem = q.level(t.priority).PushBack(t)
+	q.len++
+}
+
+// Add t to the front of the queue at its priority, ahead of the tasks that
+// became ready after it.
+func (q *taskQueue) pushFront(t *task) {
+	t.elem = q.level(t.priority).PushFront(t)
+	q.len++
+}
+
+// Returns the FIFO for priority, creating it if it doesn't exist.
+func (q *taskQueue) level(priority int) *list.List {
+	l := q.levels[priority]
+	if l == nil {
+		l = list.New()
+		q.levels[priority] = l
+		n := sort.Search(len(q.priorities), func(n int) bool { return q.priorities[n] < priority })
+		q.priorities = append(q.priorities, 0)
+		copy(q.priorities[n+1:], q.priorities[n:])
+		q.priorities[n] = priority
+	}
+	return l
+}
+
+// Remove t from the queue. It is a no-op if t isn't queued.
+func (q *taskQueue) remove(t *task) {
+	if t.elem == nil {
+		return
+	}
+	l := q.levels[t.priority]
+	l.Remove(t.elem)
+	t.elem = nil
+	if l.Len() == 0 {
+		delete(q.levels, t.priority)
+		n := sort.Search(len(q.priorities), func(n int) bool { return q.priorities[n] <= t.priority })
+		q.priorities = append(q.priorities[:n], q.priorities[n+1:]...)
+	}
+	q.len--
+}
+
+// Returns the task that should be dispatched next and its effective priority,
+// or nil if the queue is empty. An aging interval of 0 disables aging.
+func (q *taskQueue) peek(now time.Time, aging time.Duration) (*task, int) {
+	if len(q.priorities) == 0 {
+		return nil, 0
+	} else if aging <= 0 {
+		return q.levels[q.priorities[0]].Front().Value.(*task), q.priorities[0]
+	}
+	var best *task
+	var bestPriority int
+	for _, priority := range q.priorities {
+		t := q.levels[priority].Front().Value.(*task)
+		// The front of each FIFO has usually waited longest, so it also has
+		// the highest effective priority in it.
+		priority += int(now.Sub(t.submitted) / aging)
+		if best == nil || priority > bestPriority || (priority == bestPriority && t.id < best.id) {
+			best, bestPriority = t, priority
+		}
+	}
+	return best, bestPriority
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/akramer/lateral/platform"
+)
+
+// Open the files named by the task's Stdin, Stdout and Stderr templates, and
+// put them in place of the corresponding received fds in files, which is
+// returned grown if need be. Relative paths are relative to the task's
+// working directory.
+func redirect(t *task, files []*os.File) ([]*os.File, error) {
+	r := t.request.Run
+	templates := []string{r.Stdin, r.Stdout, r.Stderr}
+	paths := make([]string, len(templates))
+	for fd, s := range templates {
+		if s == "" {
+			continue
+		}
+		paths[fd] = expandTemplate(s, t)
+		if !filepath.IsAbs(paths[fd]) {
+			paths[fd] = filepath.Join(r.Cwd, paths[fd])
+		}
+		for len(files) <= fd {
+			files = append(files, nil)
+		}
+	}
+	for fd, path := range paths {
+		if path == "" {
+			continue
+		}
+		var f *os.File
+		var err error
+		if fd == 0 {
+			f, err = os.Open(path)
+		} else if fd == 2 && path == paths[1] {
+			// As with 2>&1, rather than two writers clobbering each other.
+			var nfd int
+			if nfd, err = platform.DupCloexec(int(files[1].Fd())); err == nil {
+				f = os.NewFile(uintptr(nfd), path)
+			}
+		} else {
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		}
+		if err != nil {
+			return files, err
+		}
+		if files[fd] != nil {
+			files[fd].Close()
+		}
+		files[fd] = f
+	}
+	return files, nil
+}
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"container/list"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/akramer/lateral/platform"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
 )
@@ -20,8 +25,8 @@ type instance struct {
 	m sync.Mutex
 	// Number of process slots available for use
 	slots int
-	// When slots is incremented by 1, Signal cond
-	// Otherwise, when slots is changed, Broadcast cond
+	// Signal when slots is incremented, a task is queued, or the server shuts
+	// down. The broker waits on it for work to dispatch.
 	slotAvailable *sync.Cond
 	// Broadcast every time a running task is finished.
 	taskFinished *sync.Cond
@@ -30,36 +35,147 @@ type instance struct {
 	shuttingDown     bool
 	shutdownComplete bool
 
-	pending  []*Request
-	running  []*Request
-	finished []finishedProcess
-}
+	// nil if the server never halts
+	halt *haltPolicy
+	// Why the server halted, or "" if it hasn't
+	halted string
+	// Number of tasks that ran and finished successfully or unsuccessfully
+	succeeded int
+	failed    int
+	// Number of tasks that have finished, for ordering them
+	finishCount int
+
+	// ID assigned to the most recently submitted task
+	lastId int
+	// All tasks the server knows about, indexed by ID
+	tasks map[int]*task
+
+	// Number of tasks in the pending state, including those waiting to be
+	// retried.
+	pending int
+	running map[int]*task
+	// Number of tasks that have exited, but are waiting for their output to
+	// be written
+	flushing int
+	finished []*task
+	// Finished tasks of the current epoch that no wait with Any set has
+	// reported, in finish order
+	unreported *list.List
+	// Tasks are queued and limited per group. Tasks submitted without a group
+	// belong to the group named "".
+	groups map[string]*group
+	// Identical environments of different tasks share one slice.
+	envs map[string]*sharedEnv
+	// Memory for buffered output, or nil if it is unlimited
+	buffers *budget
+	// Locks on where captured output is written
+	dsts dstLocks
+	// How long output is still waited for from a task's pipes after its
+	// process exits, while children it left in the background hold them open
+	outputGrace time.Duration
+
+	// ID of the first task submitted in the current epoch
+	epochStart int
+	// Tallies of the current epoch's finished tasks that have been
+	// forgotten, by group
+	pruned map[string]*tally
 
-type finishedProcess struct {
-	request *Request
-	state   *os.ProcessState
+	// Writes to the job log and spool directory
+	work *workQueue
+	// nil unless finished tasks are logged
+	joblog *Joblog
+	// The job log given to --resume, or nil if not resuming
+	resume *ResumeLog
+
+	// Where tasks' output is spooled, or "" if it isn't
+	spoolDir string
+	// Total size of the finished tasks' spool files, which are listed oldest
+	// first. Only used by work, so not guarded by m.
+	spoolSize int64
+	spooled   []spooled
 }
 
 var funcMap = map[RequestType]func(*instance, *Request) (*Response, error){
-	REQUEST_GETPID:   (*instance).cmdGetpid,
-	REQUEST_RUN:      (*instance).cmdRun,
-	REQUEST_KILL:     (*instance).cmdKill,
-	REQUEST_WAIT:     (*instance).cmdWait,
-	REQUEST_SHUTDOWN: (*instance).cmdShutdown,
-	REQUEST_CONFIG:   (*instance).cmdConfig,
+	REQUEST_GETPID:       (*instance).cmdGetpid,
+	REQUEST_RUN:          (*instance).cmdRun,
+	REQUEST_KILL:         (*instance).cmdKill,
+	REQUEST_WAIT:         (*instance).cmdWait,
+	REQUEST_SHUTDOWN:     (*instance).cmdShutdown,
+	REQUEST_CONFIG:       (*instance).cmdConfig,
+	REQUEST_STATUS:       (*instance).cmdStatus,
+	REQUEST_REPRIORITIZE: (*instance).cmdReprioritize,
+	REQUEST_CANCEL:       (*instance).cmdCancel,
 }
 
 func newInstance(v *viper.Viper) *instance {
 	var i = instance{
-		viper: v,
-		slots: v.GetInt("start.parallel"),
+		viper:      v,
+		slots:      v.GetInt("start.parallel"),
+		tasks:      make(map[int]*task),
+		running:    make(map[int]*task),
+		groups:     make(map[string]*group),
+		envs:       make(map[string]*sharedEnv),
+		unreported: list.New(),
+		work:       newWorkQueue(),
 	}
+	i.resetEpoch(0)
+	i.buffers = newBudget(v.GetInt("start.buffer_max"))
+	i.outputGrace = time.Second
 	i.slotAvailable = sync.NewCond(&i.m)
 	i.taskFinished = sync.NewCond(&i.m)
+	h, err := parseHaltPolicy(v.GetString("start.halt"))
+	if err != nil {
+		glog.Errorln("Ignoring halt policy:", err)
+	}
+	i.halt = h
+	if path := v.GetString("start.joblog"); path != "" {
+		i.joblog, err = OpenJoblog(path, v.GetBool("start.joblog_usage"))
+		if err != nil {
+			glog.Errorln("Not writing a job log:", err)
+		}
+	}
+	if v.GetBool("start.spool") {
+		i.openSpoolDir()
+	}
+	if path := v.GetString("start.resume"); path != "" {
+		i.resume, err = ReadJoblog(path)
+		if err != nil {
+			glog.Errorln("Not resuming:", err)
+		}
+	}
 	return &i
 }
 
+// The broker owns dispatch: it starts the next queued task whenever a slot is
+// free. Pending tasks cost no goroutines, only running ones do.
+// Returns once the server has shut down.
 func (i *instance) broker() {
+	i.m.Lock()
+	defer i.m.Unlock()
+	for {
+		var t *task
+		for !i.shutdownComplete {
+			if i.slots > 0 {
+				t = i.nextTask(time.Now())
+				if t != nil {
+					break
+				}
+			}
+			i.slotAvailable.Wait()
+		}
+		if i.shutdownComplete {
+			return
+		}
+		i.slots--
+		i.running[t.id] = t
+		i.pending--
+		t.group.running++
+		t.group.pending--
+		t.state = TASK_RUNNING
+		a := &attempt{started: time.Now()}
+		t.attempts = append(t.attempts, a)
+		go i.runTask(t, a)
+	}
 }
 
 // Run the server's accept loop, waiting for connections from l.
@@ -71,6 +187,7 @@ func (i *instance) broker() {
 func Run(v *viper.Viper, l *net.UnixListener) {
 	i := newInstance(v)
 	i.listener = l
+	go i.broker()
 	for {
 		c, err := l.AcceptUnix()
 		i.m.Lock()
@@ -112,6 +229,7 @@ func (i *instance) connectionHandler(c *net.UnixConn) {
 		}
 		if err != nil {
 			glog.Errorln("Failed to read a message from socket:", err)
+			return
 		}
 		f, t := funcMap[req.Type]
 		if t != true {
@@ -140,48 +258,145 @@ func (i *instance) cmdGetpid(req *Request) (*Response, error) {
 	return &r, nil
 }
 
-// Delete target from r. Returns the new slice.
-func del(r []*Request, target *Request) []*Request {
-	var i int
-	for i = 0; r[i] != target && i < len(r); i++ {
+// Run a single attempt of t, which the broker has already moved to the
+// running state.
+func (i *instance) runTask(t *task, a *attempt) {
+	ps, c := i.runAttempt(t, a)
+	i.putRunSlot(t, a, ps)
+	if c != nil {
+		c.finish()
 	}
-	if i == len(r) {
-		return r
+	if i.endAttempt(t) {
+		i.finishInOrder(t)
 	}
-	r, r[len(r)-1] = append(r[:i], r[i+1:]...), nil
-	return r
 }
 
-// Wait for a request slot to open, consume it, and move the request from the pending to the running queue.
-// Consumes a slot.
-func (i *instance) getRunSlot(req *Request) {
+// Remove the task from the running set once its process has exited, and
+// move it to the flushing state until its output has been written.
+// Frees up a slot.
+func (i *instance) putRunSlot(t *task, a *attempt, ps *os.ProcessState) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	a.ended = time.Now()
+	a.ps = ps
+	delete(i.running, t.id)
+	t.group.running--
+	t.state = TASK_FLUSHING
+	i.flushing++
+	t.group.flushing++
+	i.slots++
+	i.slotAvailable.Signal()
+}
+
+// Once the output of the task's last attempt has been written, queue the
+// task again after the retry delay if the attempt should be retried.
+// Otherwise the task is added to the finished list, unless its output is kept
+// in order, in which case it stays flushing, true is returned and the caller
+// must finish it with finishInOrder.
+func (i *instance) endAttempt(t *task) (inOrder bool) {
 	i.m.Lock()
 	defer i.m.Unlock()
-	for i.slots <= 0 {
-		i.slotAvailable.Wait()
+	retry := t.shouldRetry()
+	if !retry && i.orderer(t) != nil {
+		return true
+	}
+	i.flushing--
+	t.group.flushing--
+	if retry {
+		delay := t.retryDelay()
+		glog.Infof("Task %d failed on attempt %d, retrying in %v", t.id, len(t.attempts), delay)
+		t.state = TASK_PENDING
+		i.pending++
+		t.group.pending++
+		// The received fds are kept open until the last attempt, and each
+		// attempt gets its own duplicates.
+		time.AfterFunc(delay, func() { i.requeue(t) })
+	} else {
+		i.finish(t)
 	}
-	i.slots--
-	i.pending = del(i.pending, req)
-	i.running = append(i.running, req)
+	i.taskFinished.Broadcast()
+	return false
 }
 
-// Remove request from the running queue and add the finished queue.
-// Frees up a slot.
-func (i *instance) putRunSlot(req *Request, ps *os.ProcessState) {
+// Move t to the finished list, and release or skip the tasks that depend on
+// it. Must be called with i.m held.
+func (i *instance) finish(t *task) {
+	t.state = TASK_FINISHED
+	i.finishCount++
+	t.finishSeq = i.finishCount
+	t.finishedAt = time.Now()
+	t.closeFds()
+	if o := i.orderer(t); o != nil {
+		o.remove(t.id)
+	}
+	i.finished = append(i.finished, t)
+	if t.id >= i.epochStart {
+		t.unreported = i.unreported.PushBack(t)
+	}
+	i.releaseGroup(t.group)
+	i.logJob(t)
+	i.accountSpool(t)
+	i.prune(t.finishedAt)
+	if t.skipped == "" && !t.cancelled && t.resumed == "" {
+		i.checkHalt(t)
+	}
+	ok := t.succeeded()
+	for _, d := range t.dependents {
+		if d.state != TASK_PENDING {
+			continue // Already skipped because of another dependency.
+		}
+		if !ok {
+			i.skip(d, fmt.Sprintf("dependency %d did not succeed", t.id))
+			continue
+		}
+		d.waitingOn--
+		if d.waitingOn == 0 {
+			i.enqueue(d)
+		}
+	}
+	t.dependents = nil
+}
+
+// Finish a pending task without running it. Must be called with i.m held.
+func (i *instance) skip(t *task, reason string) {
+	glog.Infof("Skipping task %d: %s", t.id, reason)
+	t.skipped = reason
+	i.dropPending(t)
+}
+
+// Finish a pending task without running it, because it was cancelled.
+// Must be called with i.m held.
+func (i *instance) cancelPending(t *task) {
+	glog.Infof("Cancelling pending task %d", t.id)
+	t.cancelled = true
+	i.dropPending(t)
+}
+
+// Must be called with i.m held.
+func (i *instance) dropPending(t *task) {
+	t.group.queue.remove(t)
+	i.pending--
+	t.group.pending--
+	i.finish(t)
+	i.taskFinished.Broadcast()
+}
+
+// Put a task that is waiting to be retried back in the queue.
+func (i *instance) requeue(t *task) {
 	i.m.Lock()
 	defer i.m.Unlock()
-	i.finished = append(i.finished, finishedProcess{
-		request: req,
-		state:   ps,
-	})
-	i.running = del(i.running, req)
-	i.slots++
+	if t.state != TASK_PENDING {
+		return // Cancelled while waiting.
+	}
+	t.group.queue.pushFront(t)
 	i.slotAvailable.Signal()
-	i.taskFinished.Broadcast()
 }
 
-func (i *instance) doRunInGoroutine(req *Request) {
-	i.getRunSlot(req)
+// Start the task's process and wait for it to exit. Returns nil if the
+// process couldn't be started, and the capture of its output, which must be
+// finished, or nil if it isn't captured.
+func (i *instance) runAttempt(t *task, a *attempt) (*os.ProcessState, *capture) {
+	req := t.request
 	var max int
 	for _, v := range req.Fds {
 		if v+1 > max {
@@ -189,15 +404,36 @@ func (i *instance) doRunInGoroutine(req *Request) {
 		}
 	}
 	f := make([]*os.File, max)
-	for i, v := range req.Fds {
-		f[v] = os.NewFile(uintptr(req.ReceivedFds[i]), "fd")
+	for n, v := range req.Fds {
+		fd, err := platform.DupCloexec(req.ReceivedFds[n])
+		if err != nil {
+			glog.Errorf("Error duplicating fd %d for task %d: %v", v, t.id, err)
+			continue
+		}
+		f[v] = os.NewFile(uintptr(fd), "fd")
+	}
+	f, err := redirect(t, f)
+	if err != nil {
+		for _, v := range f {
+			if v != nil {
+				v.Close()
+			}
+		}
+		glog.Errorf("Error redirecting task %d: %v", t.id, err)
+		i.m.Lock()
+		a.startErr = err.Error()
+		i.m.Unlock()
+		return nil, nil
 	}
+	c := i.captureOutput(t, f)
 	attr := &os.ProcAttr{
 		Env:   req.Run.Env,
 		Dir:   req.Run.Cwd,
 		Files: f,
+		// Each task gets its own process group, so a timeout can stop the
+		// children it started too.
+		Sys: &syscall.SysProcAttr{Setpgid: true},
 	}
-	// TODO: add running process to the running list
 	p, err := os.StartProcess(req.Run.Exe, req.Run.Args, attr)
 	for _, v := range attr.Files {
 		if v != nil {
@@ -205,26 +441,195 @@ func (i *instance) doRunInGoroutine(req *Request) {
 		}
 	}
 	if err != nil {
-		glog.Errorln("Error running command:", err)
-		i.putRunSlot(req, nil)
-		return
+		glog.Errorf("Error running task %d: %v", t.id, err)
+		i.m.Lock()
+		a.startErr = err.Error()
+		i.m.Unlock()
+		return nil, c
+	}
+	i.m.Lock()
+	a.pid = p.Pid
+	a.process = p
+	if t.cancelled {
+		// Cancelled while the process was being started.
+		syscall.Kill(-p.Pid, t.cancelSignal)
+	}
+	i.m.Unlock()
+	timeout, killAfter := i.timeouts(req.Run)
+	stop := func() {}
+	if timeout > 0 {
+		stop = i.enforceTimeout(t, a, p, timeout, killAfter)
 	}
 	ps, err := p.Wait()
-	i.putRunSlot(req, ps)
+	stop()
+	return ps, c
+}
+
+// Returns the timeout and SIGKILL grace period for r, falling back to the
+// server's defaults.
+func (i *instance) timeouts(r *RequestRun) (timeout, killAfter time.Duration) {
+	timeout, killAfter = r.Timeout, r.KillAfter
+	if timeout == 0 {
+		timeout = i.viper.GetDuration("start.timeout")
+	}
+	if killAfter == 0 {
+		killAfter = i.viper.GetDuration("start.kill_after")
+	}
+	return timeout, killAfter
+}
+
+// Send p's process group SIGTERM once timeout elapses, followed by SIGKILL
+// if it is still running killAfter later. The returned func cancels any
+// signals that haven't been sent yet, and must be called once p has been
+// reaped.
+func (i *instance) enforceTimeout(t *task, a *attempt, p *os.Process, timeout, killAfter time.Duration) func() {
+	var m sync.Mutex
+	var stopped bool
+	var kill *time.Timer
+	term := time.AfterFunc(timeout, func() {
+		m.Lock()
+		defer m.Unlock()
+		// A process that has already been reaped exited by itself.
+		if stopped || p.Signal(syscall.Signal(0)) != nil {
+			return
+		}
+		i.m.Lock()
+		a.timedOut = true
+		i.m.Unlock()
+		glog.Infof("Task %d timed out after %v, sending SIGTERM", t.id, timeout)
+		syscall.Kill(-p.Pid, syscall.SIGTERM)
+		kill = time.AfterFunc(killAfter, func() {
+			glog.Infof("Task %d still running %v after SIGTERM, sending SIGKILL", t.id, killAfter)
+			syscall.Kill(-p.Pid, syscall.SIGKILL)
+		})
+	})
+	return func() {
+		term.Stop()
+		m.Lock()
+		defer m.Unlock()
+		stopped = true
+		if kill != nil {
+			kill.Stop()
+		}
+	}
 }
 
-func (i *instance) cmdRun(req *Request) (*Response, error) {
+// Check that r's executable and working directory are usable, so that
+// obviously broken tasks are rejected when they're submitted, rather than
+// failing once they get a slot.
+func checkRun(r *RequestRun) error {
+	if r.Cwd != "" {
+		info, err := os.Stat(r.Cwd)
+		if err != nil {
+			return fmt.Errorf("Invalid working directory: %v", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("Working directory %s is not a directory", r.Cwd)
+		}
+	}
+	// A relative executable is found from the working directory.
+	exe := r.Exe
+	if !filepath.IsAbs(exe) {
+		exe = filepath.Join(r.Cwd, exe)
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return fmt.Errorf("Invalid executable: %v", err)
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("Executable %s is not a regular file", r.Exe)
+	} else if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", r.Exe)
+	}
+	return nil
+}
+
+func (i *instance) cmdRun(req *Request) (resp *Response, err error) {
+	// Once the task is accepted it owns the received fds, and closes them
+	// when it finishes. Otherwise the client's reader would never see EOF.
+	defer func() {
+		if err != nil {
+			for _, fd := range req.ReceivedFds {
+				syscall.Close(fd)
+			}
+		}
+	}()
 	if req.Run == nil {
 		return nil, fmt.Errorf("Missing RequestRun struct")
 	}
+	if err := checkRun(req.Run); err != nil {
+		return nil, err
+	}
 	i.m.Lock()
 	defer i.m.Unlock()
 	if i.shuttingDown {
 		return nil, fmt.Errorf("Cannot send requests to a shutting down server.")
 	}
-	i.pending = append(i.pending, req)
-	go i.doRunInGoroutine(req)
-	return &Response{Type: RESPONSE_OK}, nil
+	if i.halted != "" {
+		return nil, fmt.Errorf("Cannot send requests to a server that %s.", i.halted)
+	}
+	if _, ok := backoffs[req.Run.Backoff]; !ok {
+		return nil, fmt.Errorf("Unknown backoff %q", req.Run.Backoff)
+	}
+	if !outputModes[req.Run.Output] {
+		return nil, fmt.Errorf("Unknown output mode %q", req.Run.Output)
+	}
+	// Dependencies must already have been submitted, so they can never form
+	// a cycle.
+	after := make(map[int]*task)
+	for _, id := range req.Run.After {
+		d, err := i.lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		after[id] = d
+	}
+	i.lastId++
+	t := &task{
+		id:        i.lastId,
+		request:   req,
+		state:     TASK_PENDING,
+		submitted: time.Now(),
+		priority:  req.Run.Priority,
+		group:     i.group(req.Run.Group),
+	}
+	req.Run.Env = i.internEnv(req.Run.Env)
+	i.tasks[t.id] = t
+	i.pending++
+	t.group.pending++
+	if o := i.orderer(t); o != nil {
+		o.add(t.id)
+	}
+	if res := i.resumed(req.Run); res != nil {
+		t.logged = res
+		if res.succeeded() {
+			t.resumed = "succeeded in the resumed job log"
+			glog.Infof("Not running task %d: %s", t.id, t.resumed)
+			i.dropPending(t)
+		} else {
+			i.skip(t, "failed in the resumed job log")
+		}
+		return &Response{
+			Type: RESPONSE_RUN,
+			Run:  &ResponseRun{Id: t.id},
+		}, nil
+	}
+	var failed *task
+	for _, d := range after {
+		if d.state != TASK_FINISHED {
+			t.waitingOn++
+			d.dependents = append(d.dependents, t)
+		} else if !d.succeeded() {
+			failed = d
+		}
+	}
+	if failed != nil {
+		i.skip(t, fmt.Sprintf("dependency %d did not succeed", failed.id))
+	} else if t.waitingOn == 0 {
+		i.enqueue(t)
+	}
+	return &Response{
+		Type: RESPONSE_RUN,
+		Run:  &ResponseRun{Id: t.id},
+	}, nil
 }
 
 func (i *instance) cmdKill(req *Request) (*Response, error) {
@@ -247,42 +652,378 @@ func (i *instance) cmdKill(req *Request) (*Response, error) {
 	return nil, nil
 }
 
+// Functions computing wait's exit status under each exit policy, given the
+// number of tasks that failed out of the n tasks that count, the highest exit
+// code among them, and the exit code of the first to fail.
+var exitPolicies = map[string]func(failed, n, max, first int) int{
+	"any": func(failed, n, max, first int) int {
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	},
+	"all": func(failed, n, max, first int) int {
+		if failed > 0 && failed == n {
+			return 1
+		}
+		return 0
+	},
+	"max": func(failed, n, max, first int) int {
+		return max
+	},
+	"first": func(failed, n, max, first int) int {
+		return first
+	},
+	"count": func(failed, n, max, first int) int {
+		// Exit statuses above 125 have special meanings to shells.
+		if failed > 125 {
+			return 125
+		}
+		return failed
+	},
+}
+
 func (i *instance) cmdWait(req *Request) (*Response, error) {
+	rw := req.Wait
+	if rw == nil {
+		rw = &RequestWait{}
+	}
+	skipped := rw.Skipped
+	if skipped == "" {
+		skipped = "fail"
+	}
+	if skipped != "fail" && skipped != "ignore" {
+		return nil, fmt.Errorf("Unknown skipped task policy %q", skipped)
+	}
+	policy := rw.ExitPolicy
+	if policy == "" {
+		policy = "any"
+	}
+	if exitPolicies[policy] == nil {
+		return nil, fmt.Errorf("Unknown exit policy %q", policy)
+	}
+	// The other policies can return any exit status, including the 5 and
+	// 124 these waits return when they run out of tasks or time.
+	if (rw.Any || rw.Timeout > 0) && policy != "any" && policy != "all" {
+		return nil, fmt.Errorf("Exit policy %q can't be combined with waiting for any task or a timeout", policy)
+	}
+	// The job log has every task the wait reports by the time it returns.
+	defer i.work.sync()
 	i.m.Lock()
-	for len(i.running) > 0 || len(i.pending) > 0 {
+	defer i.m.Unlock()
+	// Which tasks the wait covers, and whether any of them are unfinished.
+	// Unless draining, only tasks submitted before the wait count. IDs are
+	// assigned in submission order, so they serve as generation numbers.
+	var selected func(t *task) bool
+	var unfinished func() bool
+	var tasks []*task
+	barrier := i.lastId
+	if !rw.Drain && len(rw.Ids) == 0 {
+		inGroup := func(t *task) bool { return rw.Group == "" || t.group.name == rw.Group }
+		selected = func(t *task) bool { return t.id >= i.epochStart && t.id <= barrier && inGroup(t) }
+		// Every task of the epoch before next has finished. Forgotten tasks
+		// have finished too.
+		next := i.epochStart
+		unfinished = func() bool {
+			for ; next <= barrier; next++ {
+				if t := i.tasks[next]; t != nil && t.state != TASK_FINISHED && inGroup(t) {
+					return true
+				}
+			}
+			return false
+		}
+	} else if len(rw.Ids) > 0 {
+		ids := make(map[int]bool)
+		for _, id := range rw.Ids {
+			t, err := i.lookup(id)
+			if err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, t)
+			ids[id] = true
+		}
+		selected = func(t *task) bool { return ids[t.id] }
+		unfinished = func() bool {
+			for _, t := range tasks {
+				if t.state != TASK_FINISHED {
+					return true
+				}
+			}
+			return false
+		}
+	} else if rw.Group == "" {
+		selected = func(t *task) bool { return t.id >= i.epochStart }
+		unfinished = func() bool { return len(i.running) > 0 || i.pending > 0 || i.flushing > 0 }
+	} else {
+		selected = func(t *task) bool { return t.id >= i.epochStart && t.group.name == rw.Group }
+		unfinished = func() bool {
+			g := i.groups[rw.Group]
+			return g != nil && (g.running > 0 || g.pending > 0 || g.flushing > 0)
+		}
+	}
+
+	// The timer wakes the wait up, and the wait gives up if it sees expired.
+	expired := false
+	if rw.Timeout > 0 {
+		timer := time.AfterFunc(rw.Timeout, func() {
+			i.m.Lock()
+			defer i.m.Unlock()
+			expired = true
+			i.taskFinished.Broadcast()
+		})
+		defer timer.Stop()
+	}
+	// Returns the oldest finished task that --any hasn't reported yet, or nil.
+	unreported := func() *task {
+		for e := i.unreported.Front(); e != nil; e = e.Next() {
+			if t := e.Value.(*task); selected(t) {
+				return t
+			}
+		}
+		return nil
+	}
+	done := func() bool {
+		return (rw.Any && unreported() != nil) || !unfinished()
+	}
+	for !done() && !expired {
 		i.taskFinished.Wait()
 	}
-	var exitStatus int
-	for _, p := range i.finished {
-		if p.state != nil && !p.state.Success() {
-			exitStatus = 1
+	// The timer may have fired just as the last task finished.
+	if !done() {
+		return &Response{
+			Type: RESPONSE_WAIT,
+			Wait: &ResponseWait{ExitStatus: 124, Expired: true},
+		}, nil
+	}
+	if rw.Any {
+		t := unreported()
+		if t == nil {
+			return &Response{
+				Type: RESPONSE_WAIT,
+				Wait: &ResponseWait{ExitStatus: 5},
+			}, nil
+		}
+		i.unreported.Remove(t.unreported)
+		t.unreported = nil
+		tasks = []*task{t}
+	} else if len(rw.Ids) == 0 {
+		for _, t := range i.finished {
+			if selected(t) {
+				tasks = append(tasks, t)
+			}
+		}
+	}
+	y := &tally{}
+	for _, t := range tasks {
+		y.add(t)
+	}
+	// Forgotten tasks of the epoch are only covered by waits for all of it.
+	if len(rw.Ids) == 0 && !rw.Any {
+		for name, p := range i.pruned {
+			if rw.Group == "" || name == rw.Group {
+				y.merge(p)
+			}
+		}
+	}
+	w := &ResponseWait{
+		Failed:    y.failed,
+		TimedOut:  y.timedOut,
+		Skipped:   y.skipped,
+		Cancelled: y.cancelled,
+		Resumed:   y.resumed,
+		Ran:       y.ran,
+		Usage:     y.usage,
+		Elapsed:   y.ended.Sub(y.started),
+		Halted:    i.halted,
+	}
+	if len(rw.Ids) > 0 || rw.Any {
+		for _, t := range tasks {
+			w.Tasks = append(w.Tasks, t.status())
+		}
+	}
+	for _, t := range tasks {
+		if a := t.lastAttempt(); a != nil && a.startErr != "" {
+			w.StartFailures = append(w.StartFailures, StartFailure{Id: t.id, Error: a.startErr})
+		}
+	}
+	sort.Slice(w.StartFailures, func(a, b int) bool { return w.StartFailures[a].Id < w.StartFailures[b].Id })
+	failed, n, max, first := y.failed+y.timedOut, y.ran+y.resumed, y.maxCode, y.firstFailedCode
+	if skipped == "fail" && y.skipped > 0 {
+		failed += y.skipped
+		n += y.skipped
+		if max < 1 {
+			max = 1
+		}
+		if earliest(y.firstFailed, y.firstSkipped) == y.firstSkipped {
+			first = 1
 		}
 	}
+	// Only the default policy reports halts and timeouts specially. The
+	// others describe the tasks themselves.
 	if i.errorOccurred == true {
-		exitStatus = 2
+		w.ExitStatus = 2
+	} else if policy == "any" && i.halted != "" {
+		w.ExitStatus = 4
+	} else if policy == "any" && w.TimedOut > 0 {
+		w.ExitStatus = 3
+	} else {
+		w.ExitStatus = exitPolicies[policy](failed, n, max, first)
+	}
+	if rw.Reset {
+		i.resetEpoch(barrier)
 	}
-	i.m.Unlock()
 	resp := &Response{
 		Type: RESPONSE_WAIT,
-		Wait: &ResponseWait{
-			ExitStatus: exitStatus,
-		},
+		Wait: w,
 	}
 	return resp, nil
 }
 
+func (i *instance) cmdStatus(req *Request) (*Response, error) {
+	if req.Status == nil {
+		return nil, fmt.Errorf("Missing RequestStatus struct")
+	}
+	want := make(map[TaskState]bool)
+	for _, s := range req.Status.States {
+		want[s] = true
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.prune(time.Now())
+	ids := make([]int, 0, len(i.tasks))
+	for id, t := range i.tasks {
+		if req.Status.Group != "" && t.group.name != req.Status.Group {
+			continue
+		}
+		if len(want) == 0 || want[t.state] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	tasks := make([]TaskStatus, len(ids))
+	for n, id := range ids {
+		tasks[n] = i.tasks[id].status()
+	}
+	return &Response{
+		Type:   RESPONSE_STATUS,
+		Status: &ResponseStatus{Tasks: tasks},
+	}, nil
+}
+
+func (i *instance) cmdReprioritize(req *Request) (*Response, error) {
+	if req.Reprioritize == nil {
+		return nil, fmt.Errorf("Missing RequestReprioritize struct")
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	t, err := i.lookup(req.Reprioritize.Id)
+	if err != nil {
+		return nil, err
+	} else if t.state != TASK_PENDING {
+		return nil, fmt.Errorf("Task %d is %v, only pending tasks can be reprioritized", t.id, t.state)
+	}
+	// Tasks waiting out a retry delay or for their dependencies aren't
+	// queued.
+	queued := t.elem != nil
+	t.group.queue.remove(t)
+	t.priority = req.Reprioritize.Priority
+	if queued {
+		i.enqueue(t)
+	}
+	return &Response{Type: RESPONSE_OK}, nil
+}
+
+func (i *instance) cmdCancel(req *Request) (*Response, error) {
+	if req.Cancel == nil {
+		return nil, fmt.Errorf("Missing RequestCancel struct")
+	}
+	sig := syscall.Signal(req.Cancel.Signal)
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	var targets []*task
+	for _, id := range req.Cancel.Ids {
+		t, err := i.lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	if req.Cancel.AllPending || req.Cancel.Running {
+		for _, t := range i.tasks {
+			if (req.Cancel.AllPending && t.state == TASK_PENDING) || (req.Cancel.Running && t.state == TASK_RUNNING) {
+				targets = append(targets, t)
+			}
+		}
+	}
+	resp := &ResponseCancel{}
+	seen := make(map[*task]bool)
+	for _, t := range targets {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		switch {
+		case t.state == TASK_PENDING:
+			i.cancelPending(t)
+			resp.Cancelled = append(resp.Cancelled, t.id)
+		case t.state == TASK_RUNNING:
+			i.cancelRunning(t, sig)
+			resp.Signalled = append(resp.Signalled, t.id)
+		default:
+			// Finished, or exited and waiting for its output to be
+			// written, so there is nothing left to cancel.
+			resp.Finished = append(resp.Finished, t.id)
+		}
+	}
+	sort.Ints(resp.Cancelled)
+	sort.Ints(resp.Signalled)
+	sort.Ints(resp.Finished)
+	return &Response{
+		Type:   RESPONSE_CANCEL,
+		Cancel: resp,
+	}, nil
+}
+
+// Signal a running task, and record it as cancelled. Must be called with i.m
+// held.
+func (i *instance) cancelRunning(t *task, sig syscall.Signal) {
+	glog.Infof("Cancelling running task %d with %v", t.id, sig)
+	t.cancelled = true
+	t.cancelSignal = sig
+	// If the process hasn't been started yet, runAttempt signals it. Like
+	// a timeout, this reaches the children in the task's process group too.
+	if a := t.lastAttempt(); a.process != nil {
+		syscall.Kill(-a.pid, sig)
+	}
+}
+
 func (i *instance) cmdConfig(req *Request) (*Response, error) {
 	if req.Config == nil {
 		return nil, fmt.Errorf("Missing RequestConfig struct")
 	}
 	i.m.Lock()
 	defer i.m.Unlock()
-	if req.Config.Parallel != nil {
+	if req.Config.Parallel != nil && req.Config.Group != "" {
+		g := i.group(req.Config.Group)
+		glog.Infof("Changing parallelism of group %q from %d to %d", g.name, g.parallel, *req.Config.Parallel)
+		g.parallel = *req.Config.Parallel
+		if g.parallel < 0 {
+			g.parallel = -1
+			i.releaseGroup(g)
+		}
+		i.slotAvailable.Signal()
+	} else if req.Config.Parallel != nil {
+		if *req.Config.Parallel < 0 {
+			return nil, fmt.Errorf("Parallelism can't be negative")
+		}
 		diff := i.viper.GetInt("start.parallel") - *req.Config.Parallel
 		glog.Infof("Changing parallelism: adding %d slots", -diff)
 		i.slots -= diff
 		i.viper.Set("start.parallel", req.Config.Parallel)
-		i.slotAvailable.Broadcast()
+		i.slotAvailable.Signal()
 	}
 	return &Response{Type: RESPONSE_OK}, nil
 }
@@ -290,14 +1031,27 @@ func (i *instance) cmdConfig(req *Request) (*Response, error) {
 func (i *instance) cmdShutdown(req *Request) (*Response, error) {
 	i.m.Lock()
 	i.shuttingDown = true
+	// Tasks submitted after the last wait started will never get a slot.
+	for _, t := range i.tasks {
+		if t.state == TASK_PENDING {
+			i.cancelPending(t)
+		}
+	}
 	// Reduce concurrency to 0. If tasks are running, slots will go negative, but
 	// will eventually be incremented to 0 once they're finished.
 	i.slots -= i.viper.GetInt("start.parallel")
-	for i.slots < 0 {
+	for i.slots < 0 || i.flushing > 0 {
 		i.taskFinished.Wait()
 	}
 	defer i.m.Unlock()
 	i.shutdownComplete = true
+	if i.joblog != nil {
+		i.work.add(i.joblog.Close)
+		i.joblog = nil
+	}
+	// The work doesn't take i.m.
+	i.work.sync()
+	i.slotAvailable.Signal()
 	i.listener.Close()
 	return &Response{Type: RESPONSE_OK}, nil
 }
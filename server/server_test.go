@@ -1,15 +1,26 @@
 package server
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 func makeTestInstance(v *viper.Viper) *instance {
-	return newInstance(v)
+	i := newInstance(v)
+	go i.broker()
+	return i
 }
 
 func makeTestViper() *viper.Viper {
@@ -18,6 +29,72 @@ func makeTestViper() *viper.Viper {
 	return v
 }
 
+// Returns the path of an executable file that passes checkRun, but can't be
+// started.
+func makeUnstartable(t *testing.T) string {
+	f, err := ioutil.TempFile("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Without a #! line, this fails with ENOEXEC.
+	if _, err = f.WriteString("not a program\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Chmod(0755); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// Block until the task with the given ID reaches state.
+func waitForState(t *testing.T, i *instance, id int, state TaskState) {
+	for n := 0; n < 1000; n++ {
+		i.m.Lock()
+		s := i.tasks[id].state
+		i.m.Unlock()
+		if s == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %d never became %v", id, state)
+}
+
+// Returns a request that runs the executable name, looked up in $PATH, with
+// args.
+func makeRequest(t *testing.T, name string, args ...string) *Request {
+	exe, err := exec.LookPath(name)
+	if err != nil {
+		t.Fatalf("Couldn't find executable '%s': %v", name, err)
+	}
+	return &Request{
+		Type: REQUEST_RUN,
+		Run: &RequestRun{
+			Exe:  exe,
+			Args: append([]string{exe}, args...),
+		},
+	}
+}
+
+// Submit req, failing the test if it isn't accepted. Returns the task's ID.
+func submit(t *testing.T, i *instance, req *Request) int {
+	resp, err := i.cmdRun(req)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	return resp.Run.Id
+}
+
+// Wait as rw describes, failing the test if the wait is rejected.
+func wait(t *testing.T, i *instance, rw *RequestWait) *ResponseWait {
+	resp, err := i.cmdWait(&Request{Type: REQUEST_WAIT, Wait: rw})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	return resp.Wait
+}
+
 func TestRunGetpid(t *testing.T) {
 	i := makeTestInstance(makeTestViper())
 	r := Request{Type: REQUEST_GETPID}
@@ -72,3 +149,1255 @@ func TestWait(t *testing.T) {
 		t.Error("Exit status wasn't 1")
 	}
 }
+
+func TestRunIds(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 0)
+	i := makeTestInstance(v)
+	for want := 1; want <= 3; want++ {
+		if id := submit(t, i, makeRequest(t, "true")); id != want {
+			t.Errorf("got task ID %d, wanted %d", id, want)
+		}
+		if i.tasks[want] == nil {
+			t.Errorf("task %d isn't tracked by the server", want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 0)
+	i := makeTestInstance(v)
+	for _, name := range []string{"true", "false"} {
+		submit(t, i, makeRequest(t, name))
+	}
+
+	pending := &Request{
+		Type:   REQUEST_STATUS,
+		Status: &RequestStatus{States: []TaskState{TASK_PENDING}},
+	}
+	resp, err := i.cmdStatus(pending)
+	if err != nil {
+		t.Fatal("got error", err)
+	} else if len(resp.Status.Tasks) != 2 {
+		t.Fatalf("got %d pending tasks, wanted 2", len(resp.Status.Tasks))
+	}
+
+	parallel := 10
+	i.cmdConfig(&Request{Type: REQUEST_CONFIG, Config: &RequestConfig{Parallel: &parallel}})
+	wait(t, i, nil)
+
+	resp, err = i.cmdStatus(pending)
+	if err != nil {
+		t.Fatal("got error", err)
+	} else if len(resp.Status.Tasks) != 0 {
+		t.Errorf("got %d pending tasks, wanted 0", len(resp.Status.Tasks))
+	}
+	resp, err = i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	tasks := resp.Status.Tasks
+	if len(tasks) != 2 {
+		t.Fatalf("got %d tasks, wanted 2", len(tasks))
+	}
+	for n, want := range []int{0, 1} {
+		if tasks[n].Id != n+1 {
+			t.Errorf("task %d has ID %d", n+1, tasks[n].Id)
+		}
+		if tasks[n].State != TASK_FINISHED {
+			t.Errorf("task %d is %v, wanted finished", tasks[n].Id, tasks[n].State)
+		}
+		if tasks[n].ExitStatus != want {
+			t.Errorf("task %d exited %d, wanted %d", tasks[n].Id, tasks[n].ExitStatus, want)
+		}
+		if tasks[n].Pid == 0 || tasks[n].Started.IsZero() || tasks[n].Ended.IsZero() {
+			t.Errorf("task %d is missing pid or timing: %+v", tasks[n].Id, tasks[n])
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.kill_after", 100*time.Millisecond)
+	i := makeTestInstance(v)
+	// The first task exits on SIGTERM, the second has to be SIGKILLed.
+	for _, script := range []string{"exec sleep 10", "trap '' TERM; while :; do :; done"} {
+		req := makeRequest(t, "sh", "-c", script)
+		req.Run.Timeout = 100 * time.Millisecond
+		submit(t, i, req)
+	}
+	if w := wait(t, i, nil); w.ExitStatus != 3 || w.TimedOut != 2 || w.Failed != 0 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	resp, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	for n, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		task := resp.Status.Tasks[n]
+		if !task.TimedOut || task.Signal != int(sig) {
+			t.Errorf("task %d: wanted timeout with %v, got %+v", task.Id, sig, task)
+		}
+	}
+}
+
+func TestTimeoutProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	i := makeTestInstance(makeTestViper())
+	// The background child would create the file if it outlived the timeout.
+	file := filepath.Join(dir, "survived")
+	req := makeRequest(t, "sh", "-c", "(sleep 0.5; touch "+file+") & exec sleep 10")
+	req.Run.Timeout = 100 * time.Millisecond
+	submit(t, i, req)
+	wait(t, i, nil)
+	time.Sleep(700 * time.Millisecond)
+	if _, err = os.Stat(file); err == nil {
+		t.Error("The task's child survived the timeout")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	counter := t.TempDir() + "/counter"
+	// Fails with status 7 until the third attempt.
+	script := `n=$(cat "$0" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$0"; [ $n -ge 3 ] || exit 7`
+	reqs := []*Request{makeRequest(t, "sh", "-c", script, counter), makeRequest(t, "sh", "-c", "exit 1")}
+	reqs[0].Run.Backoff = "exp"
+	for _, req := range reqs {
+		req.Run.Retries = 5
+		req.Run.RetryOn = []int{7}
+		req.Run.RetryDelay = 10 * time.Millisecond
+		submit(t, i, req)
+	}
+	if w := wait(t, i, nil); w.Failed != 1 {
+		t.Errorf("Wanted exactly one failure, got %+v", w)
+	}
+	resp, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	for n, want := range []struct{ attempts, exit int }{{3, 0}, {1, 1}} {
+		task := resp.Status.Tasks[n]
+		if len(task.Attempts) != want.attempts || task.ExitStatus != want.exit {
+			t.Errorf("task %d: wanted %d attempts and exit %d, got %+v", task.Id, want.attempts, want.exit, task)
+		}
+	}
+
+	req := makeRequest(t, "sh")
+	req.Run.Backoff = "bogus"
+	if _, err = i.cmdRun(req); err == nil {
+		t.Error("Unknown backoff was accepted")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, c := range []struct {
+		backoff  string
+		attempts int
+		want     time.Duration
+	}{
+		{"const", 3, time.Second},
+		{"linear", 3, 3 * time.Second},
+		{"exp", 1, time.Second},
+		{"exp", 4, 8 * time.Second},
+		{"exp", 100, time.Hour},
+	} {
+		tk := &task{
+			request:  &Request{Run: &RequestRun{RetryDelay: time.Second, Backoff: c.backoff}},
+			attempts: make([]*attempt, c.attempts),
+		}
+		if got := tk.retryDelay(); got != c.want {
+			t.Errorf("%s backoff after %d attempts: got %v, wanted %v", c.backoff, c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 0)
+	i := makeTestInstance(v)
+	for _, priority := range []int{0, 0, 5, 0, 5} {
+		req := makeRequest(t, "true")
+		req.Run.Priority = priority
+		submit(t, i, req)
+	}
+	_, err := i.cmdReprioritize(&Request{
+		Type:         REQUEST_REPRIORITIZE,
+		Reprioritize: &RequestReprioritize{Id: 4, Priority: 10},
+	})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	_, err = i.cmdReprioritize(&Request{
+		Type:         REQUEST_REPRIORITIZE,
+		Reprioritize: &RequestReprioritize{Id: 6, Priority: 10},
+	})
+	if err == nil {
+		t.Error("Reprioritizing an unknown task succeeded")
+	}
+
+	parallel := 1
+	i.cmdConfig(&Request{Type: REQUEST_CONFIG, Config: &RequestConfig{Parallel: &parallel}})
+	wait(t, i, nil)
+	resp, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	tasks := resp.Status.Tasks
+	order := []int{4, 3, 5, 1, 2}
+	for n := 1; n < len(order); n++ {
+		prev, cur := tasks[order[n-1]-1], tasks[order[n]-1]
+		if !prev.Started.Before(cur.Started) {
+			t.Errorf("task %d started before task %d", cur.Id, prev.Id)
+		}
+	}
+}
+
+func TestQueueAging(t *testing.T) {
+	now := time.Now()
+	q := newTaskQueue()
+	old := &task{id: 1, priority: 0, submitted: now.Add(-5 * time.Minute)}
+	urgent := &task{id: 2, priority: 3, submitted: now}
+	q.push(old)
+	q.push(urgent)
+	if got, _ := q.peek(now, 0); got != urgent {
+		t.Errorf("without aging, got task %d first", got.id)
+	}
+	if got, priority := q.peek(now, time.Minute); got != old || priority != 5 {
+		t.Errorf("with aging, got task %d first with priority %d", got.id, priority)
+	}
+	q.remove(urgent)
+	q.remove(old)
+	if got, _ := q.peek(now, 0); q.Len() != 0 || got != nil {
+		t.Error("queue isn't empty")
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := newTaskQueue()
+	tasks := make([]*task, 5)
+	for n, priority := range []int{0, 2, 0, 1, 2} {
+		tasks[n] = &task{id: n + 1, priority: priority}
+		q.push(tasks[n])
+	}
+	// A retried task goes ahead of the others at its priority.
+	q.remove(tasks[4])
+	q.pushFront(tasks[4])
+	var order []int
+	for q.Len() > 0 {
+		got, _ := q.peek(time.Now(), 0)
+		order = append(order, got.id)
+		q.remove(got)
+	}
+	if fmt.Sprint(order) != "[5 2 4 1 3]" {
+		t.Errorf("Dispatch order was %v", order)
+	}
+}
+
+// Pending tasks shouldn't cost a goroutine each.
+func TestQueueScaling(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 0)
+	i := makeTestInstance(v)
+	before := runtime.NumGoroutine()
+	env := os.Environ()
+	for n := 0; n < 100000; n++ {
+		_, err := i.cmdRun(&Request{
+			Type: REQUEST_RUN,
+			Run: &RequestRun{
+				Exe:  "/bin/true",
+				Args: []string{"/bin/true"},
+				Env:  append([]string(nil), env...),
+			},
+		})
+		if err != nil {
+			t.Fatal("got error", err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Errorf("Queueing tasks grew the number of goroutines from %d to %d", before, after)
+	}
+	if len(i.envs) != 1 {
+		t.Errorf("Identical environments weren't shared: got %d distinct", len(i.envs))
+	}
+	if q := i.groups[""].queue; q.Len() != 100000 || i.pending != 100000 {
+		t.Errorf("Wanted 100000 queued tasks, got %d queued, %d pending", q.Len(), i.pending)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 0)
+	i := makeTestInstance(v)
+	run := func(name string, after ...int) (*Response, error) {
+		req := makeRequest(t, name)
+		req.Run.After = after
+		return i.cmdRun(req)
+	}
+	// 1 and 2 succeed, 3 fails. 4 depends on the successes, 5 on the failure,
+	// and 6 transitively on the failure.
+	for _, c := range []struct {
+		name  string
+		after []int
+	}{
+		{"true", nil}, {"true", nil}, {"false", nil},
+		{"true", []int{1, 2}}, {"true", []int{1, 3}}, {"true", []int{5}},
+	} {
+		if _, err := run(c.name, c.after...); err != nil {
+			t.Fatal("got error", err)
+		}
+	}
+	if _, err := run("true", 7); err == nil {
+		t.Error("Depending on an unknown task succeeded")
+	}
+	if q := i.groups[""].queue; q.Len() != 3 {
+		t.Errorf("Wanted only the 3 tasks without dependencies queued, got %d", q.Len())
+	}
+
+	parallel := 10
+	i.cmdConfig(&Request{Type: REQUEST_CONFIG, Config: &RequestConfig{Parallel: &parallel}})
+	if w := wait(t, i, &RequestWait{Skipped: "ignore"}); w.Failed != 1 || w.Skipped != 2 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	// A dependency that already failed skips the new task immediately.
+	if _, err := run("true", 3); err != nil {
+		t.Fatal("got error", err)
+	}
+	resp, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	for n, skipped := range []bool{false, false, false, false, true, true, true} {
+		task := resp.Status.Tasks[n]
+		if (task.Skipped != "") != skipped {
+			t.Errorf("task %d: wanted skipped=%v, got %+v", task.Id, skipped, task)
+		}
+	}
+	if resp.Status.Tasks[3].Pid == 0 {
+		t.Error("task 4 was never run")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	parallel := 1
+	_, err := i.cmdConfig(&Request{
+		Type:   REQUEST_CONFIG,
+		Config: &RequestConfig{Parallel: &parallel, Group: "serial"},
+	})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	for _, r := range []struct{ group, script string }{
+		{"serial", "sleep 0.1"}, {"serial", "sleep 0.1"}, {"serial", "sleep 0.1"}, {"other", "exit 1"},
+	} {
+		req := makeRequest(t, "sh", "-c", r.script)
+		req.Run.Group = r.group
+		submit(t, i, req)
+	}
+	if w := wait(t, i, &RequestWait{Group: "serial"}); w.ExitStatus != 0 {
+		t.Errorf("Group serial had failures: %+v", w)
+	}
+	resp, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{Group: "serial"}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	tasks := resp.Status.Tasks
+	if len(tasks) != 3 {
+		t.Fatalf("Wanted 3 tasks in group serial, got %d", len(tasks))
+	}
+	for n := 1; n < len(tasks); n++ {
+		if tasks[n].Started.Before(tasks[n-1].Ended) {
+			t.Errorf("task %d started before task %d ended", tasks[n].Id, tasks[n-1].Id)
+		}
+	}
+	if w := wait(t, i, nil); w.ExitStatus != 1 {
+		t.Errorf("Failure in group other wasn't reported: %+v", w)
+	}
+	// Groups with a limit are kept, idle ones without are forgotten.
+	i.m.Lock()
+	if i.groups["serial"] == nil || i.groups["other"] != nil {
+		t.Errorf("Unexpected groups %v", i.groups)
+	}
+	i.m.Unlock()
+	parallel = -1
+	_, err = i.cmdConfig(&Request{
+		Type:   REQUEST_CONFIG,
+		Config: &RequestConfig{Parallel: &parallel, Group: "serial"},
+	})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	i.m.Lock()
+	if len(i.groups) != 0 {
+		t.Errorf("Unexpected groups %v", i.groups)
+	}
+	i.m.Unlock()
+	if _, err = i.cmdConfig(&Request{Type: REQUEST_CONFIG, Config: &RequestConfig{Parallel: &parallel}}); err == nil {
+		t.Error("Negative server parallelism was accepted")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 1)
+	i := makeTestInstance(v)
+	for n := 0; n < 3; n++ {
+		submit(t, i, makeRequest(t, "sleep", "10"))
+	}
+	if _, err := i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{4}}}); err == nil {
+		t.Error("Cancelling an unknown task succeeded")
+	}
+	resp, err := i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{3}}})
+	if err != nil {
+		t.Fatal("got error", err)
+	} else if len(resp.Cancel.Cancelled) != 1 || resp.Cancel.Cancelled[0] != 3 {
+		t.Errorf("Unexpected cancel response %+v", resp.Cancel)
+	}
+	// Task 1 is running, task 2 is still pending.
+	waitForState(t, i, 1, TASK_RUNNING)
+	resp, err = i.cmdCancel(&Request{
+		Type:   REQUEST_CANCEL,
+		Cancel: &RequestCancel{AllPending: true, Running: true, Signal: int(syscall.SIGKILL)},
+	})
+	if err != nil {
+		t.Fatal("got error", err)
+	} else if len(resp.Cancel.Cancelled) != 1 || len(resp.Cancel.Signalled) != 1 {
+		t.Errorf("Unexpected cancel response %+v", resp.Cancel)
+	}
+	if w := wait(t, i, nil); w.ExitStatus != 0 || w.Cancelled != 3 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	resp, err = i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if task := resp.Status.Tasks[0]; task.Signal != int(syscall.SIGKILL) {
+		t.Errorf("Running task wasn't killed: %+v", task)
+	}
+	if task := resp.Status.Tasks[1]; len(task.Attempts) != 0 {
+		t.Errorf("Pending task was run: %+v", task)
+	}
+}
+
+func TestCancelProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	i := makeTestInstance(makeTestViper())
+	// The background child would create the file if it outlived the cancel.
+	file := filepath.Join(dir, "survived")
+	id := submit(t, i, makeRequest(t, "sh", "-c", "(sleep 0.5; touch "+file+") & exec sleep 10"))
+	waitForState(t, i, id, TASK_RUNNING)
+	i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{id}}})
+	wait(t, i, nil)
+	time.Sleep(700 * time.Millisecond)
+	if _, err = os.Stat(file); err == nil {
+		t.Error("The task's child survived the cancel")
+	}
+}
+
+func TestParseHaltPolicy(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want *haltPolicy
+	}{
+		{"never", nil},
+		{"now,fail=1", &haltPolicy{now: true, count: 1}},
+		{"soon,fail=25%", &haltPolicy{percent: 25}},
+		{"soon,success=3", &haltPolicy{success: true, count: 3}},
+	} {
+		got, err := parseHaltPolicy(c.in)
+		if err != nil {
+			t.Errorf("%q: got error %v", c.in, err)
+		} else if (got == nil) != (c.want == nil) || (got != nil && *got != *c.want) {
+			t.Errorf("%q: got %+v, wanted %+v", c.in, got, c.want)
+		}
+	}
+	for _, in := range []string{"now", "later,fail=1", "now,fail=0", "soon,fail=200%", "now,done=1"} {
+		if _, err := parseHaltPolicy(in); err == nil {
+			t.Errorf("%q: wanted an error", in)
+		}
+	}
+}
+
+func TestHalt(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 2)
+	v.Set("start.halt", "now,fail=1")
+	i := makeTestInstance(v)
+	// The failure halts the server while the first task is running and the
+	// third is pending.
+	for _, script := range []string{"exec sleep 10", "sleep 0.1; exit 1", "true"} {
+		submit(t, i, makeRequest(t, "sh", "-c", script))
+	}
+	if w := wait(t, i, nil); w.ExitStatus != 4 || w.Halted == "" {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	resp, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if task := resp.Status.Tasks[0]; !task.Cancelled || task.Signal != int(syscall.SIGTERM) {
+		t.Errorf("Running task wasn't terminated: %+v", task)
+	}
+	if task := resp.Status.Tasks[2]; task.Skipped == "" {
+		t.Errorf("Pending task wasn't skipped: %+v", task)
+	}
+	if _, err = i.cmdRun(makeRequest(t, "true")); err == nil {
+		t.Error("Halted server accepted a new task")
+	}
+}
+
+func TestHaltPercent(t *testing.T) {
+	h := &haltPolicy{percent: 10}
+	for _, c := range []struct {
+		n, finished, submitted int
+		want                   bool
+	}{
+		// One early failure out of the few tasks submitted so far
+		{1, 1, 5, false},
+		{1, 2, 5, false},
+		{1, 3, 5, true},
+		{1, 3, 20, false},
+		{2, 3, 20, true},
+	} {
+		if got := h.triggered(c.n, c.finished, c.submitted); got != c.want {
+			t.Errorf("%d of %d finished, %d submitted: got %v", c.n, c.finished, c.submitted, got)
+		}
+	}
+}
+
+func TestWaitIds(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	for _, script := range []string{"exit 3", "exec sleep 10", "true"} {
+		submit(t, i, makeRequest(t, "sh", "-c", script))
+	}
+	if _, err := i.cmdWait(&Request{Type: REQUEST_WAIT, Wait: &RequestWait{Ids: []int{4}}}); err == nil {
+		t.Error("Waiting for an unknown task succeeded")
+	}
+	// Task 2 is still running.
+	w := wait(t, i, &RequestWait{Ids: []int{3, 1}})
+	if w.ExitStatus != 1 || w.Failed != 1 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	tasks := w.Tasks
+	if len(tasks) != 2 || tasks[0].Id != 3 || tasks[0].ExitStatus != 0 || tasks[1].Id != 1 || tasks[1].ExitStatus != 3 {
+		t.Errorf("Unexpected tasks in wait response %+v", tasks)
+	}
+	i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{2}}})
+}
+
+func TestExitCode(t *testing.T) {
+	ran := []AttemptStatus{{Pid: 1}}
+	tests := []struct {
+		s    TaskStatus
+		want int
+	}{
+		{TaskStatus{Pid: 1, ExitStatus: 0, Attempts: ran}, 0},
+		{TaskStatus{Pid: 1, ExitStatus: 7, Attempts: ran}, 7},
+		{TaskStatus{Pid: 1, ExitStatus: -1, Signal: int(syscall.SIGINT), Attempts: ran}, 130},
+		{TaskStatus{Pid: 0, ExitStatus: -1, Attempts: []AttemptStatus{{ExitStatus: -1}}}, 127},
+		{TaskStatus{Pid: 0, Skipped: "dependency 1 did not succeed"}, 1},
+	}
+	for _, test := range tests {
+		if got := test.s.ExitCode(); got != test.want {
+			t.Errorf("ExitCode() of %+v = %d, want %d", test.s, got, test.want)
+		}
+	}
+}
+
+func TestExitPolicies(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	for _, script := range []string{"exit 3", "true", "kill -INT $$", "exit 5"} {
+		id := submit(t, i, makeRequest(t, "sh", "-c", script))
+		// Finish the tasks in order, so "first" is deterministic.
+		waitForState(t, i, id, TASK_FINISHED)
+	}
+	unstartable := makeUnstartable(t)
+	defer os.Remove(unstartable)
+	submit(t, i, makeRequest(t, unstartable))
+	tests := []struct {
+		policy string
+		ids    []int
+		want   int
+	}{
+		{"", nil, 1},
+		{"any", []int{2}, 0},
+		{"all", nil, 0},
+		{"all", []int{1, 4}, 1},
+		{"max", nil, 130},
+		{"max", []int{5}, 127},
+		{"first", nil, 3},
+		{"first", []int{4, 3}, 130},
+		{"count", nil, 4},
+	}
+	for _, test := range tests {
+		if w := wait(t, i, &RequestWait{Ids: test.ids, ExitPolicy: test.policy}); w.ExitStatus != test.want {
+			t.Errorf("Exit policy %q for tasks %v returned %d, want %d", test.policy, test.ids, w.ExitStatus, test.want)
+		}
+	}
+	if _, err := i.cmdWait(&Request{Type: REQUEST_WAIT, Wait: &RequestWait{ExitPolicy: "most"}}); err == nil {
+		t.Error("Unknown exit policy was accepted")
+	}
+}
+
+func TestWaitAny(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	for _, script := range []string{"exec sleep 10", "exit 3"} {
+		submit(t, i, makeRequest(t, "sh", "-c", script))
+	}
+	if w := wait(t, i, &RequestWait{Any: true}); len(w.Tasks) != 1 || w.Tasks[0].Id != 2 || w.ExitStatus != 1 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	// A task's exit status could be mistaken for running out of tasks.
+	rw := &RequestWait{Any: true, ExitPolicy: "max"}
+	if _, err := i.cmdWait(&Request{Type: REQUEST_WAIT, Wait: rw}); err == nil {
+		t.Error("Waiting for any task with the max exit policy succeeded")
+	}
+	// Task 2 has been reported, and task 1 is still running.
+	if w := wait(t, i, &RequestWait{Any: true, Timeout: 100 * time.Millisecond}); !w.Expired || w.ExitStatus != 124 {
+		t.Errorf("Expected the wait to time out, got %+v", w)
+	}
+	i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{1}}})
+	if w := wait(t, i, &RequestWait{Any: true}); len(w.Tasks) != 1 || w.Tasks[0].Id != 1 || w.ExitStatus != 0 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	if w := wait(t, i, &RequestWait{Any: true}); len(w.Tasks) != 0 || w.ExitStatus != 5 {
+		t.Errorf("Expected no tasks left, got %+v", w)
+	}
+	// Tasks left unreported when the epoch is reset are never reported.
+	submit(t, i, makeRequest(t, "true"))
+	wait(t, i, &RequestWait{Reset: true})
+	if w := wait(t, i, &RequestWait{Any: true}); len(w.Tasks) != 0 || w.ExitStatus != 5 {
+		t.Errorf("Expected no tasks left after the reset, got %+v", w)
+	}
+	i.m.Lock()
+	if n := i.unreported.Len(); n != 0 {
+		t.Errorf("Expected no unreported tasks, got %d", n)
+	}
+	i.m.Unlock()
+}
+
+func TestWaitBarrier(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	submit(t, i, makeRequest(t, "sleep", "10"))
+	done := make(chan *Response)
+	go func() {
+		resp, err := i.cmdWait(&Request{Type: REQUEST_WAIT, Wait: &RequestWait{}})
+		if err != nil {
+			t.Error("got error", err)
+		}
+		done <- resp
+	}()
+	// Let the wait start before submitting the second task.
+	time.Sleep(100 * time.Millisecond)
+	submit(t, i, makeRequest(t, "sleep", "10"))
+	i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{1}}})
+	select {
+	case resp := <-done:
+		if resp.Wait.Cancelled != 1 {
+			t.Errorf("Unexpected wait response %+v", resp.Wait)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return once the tasks submitted before it finished")
+	}
+	if w := wait(t, i, &RequestWait{Drain: true, Timeout: 100 * time.Millisecond}); !w.Expired {
+		t.Errorf("Draining wait returned while task 2 was running: %+v", w)
+	}
+	i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{2}}})
+}
+
+func TestEpochs(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	submit(t, i, makeRequest(t, "false"))
+	if w := wait(t, i, &RequestWait{Reset: true}); w.ExitStatus != 1 || w.Failed != 1 {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	submit(t, i, makeRequest(t, "true"))
+	if w := wait(t, i, nil); w.ExitStatus != 0 || w.Failed != 0 {
+		t.Errorf("A failure from an earlier epoch was reported: %+v", w)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.keep_finished", 2)
+	i := makeTestInstance(v)
+	for _, name := range []string{"false", "true", "true", "true"} {
+		req := makeRequest(t, name)
+		// Every task is forgotten below, and its environment with it.
+		req.Run.Env = os.Environ()
+		submit(t, i, req)
+		// Finish the tasks in order, so the failure is forgotten first.
+		wait(t, i, nil)
+	}
+	i.m.Lock()
+	if len(i.tasks) != 2 || len(i.finished) != 2 || i.tasks[1] != nil {
+		t.Errorf("Expected only tasks 3 and 4 to be kept, got %d tasks", len(i.tasks))
+	}
+	i.m.Unlock()
+	if w := wait(t, i, nil); w.ExitStatus != 1 || w.Failed != 1 {
+		t.Errorf("The forgotten failure wasn't reported: %+v", w)
+	}
+	v.Set("start.keep_finished", 0)
+	v.Set("start.keep_finished_for", time.Nanosecond)
+	status, err := i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if len(status.Status.Tasks) != 0 || len(i.envs) != 0 {
+		t.Errorf("Expected every task and environment to be forgotten, got %d tasks", len(status.Status.Tasks))
+	}
+	// Nothing is kept to wait for or depend on forgotten tasks.
+	if _, err := i.cmdWait(&Request{Type: REQUEST_WAIT, Wait: &RequestWait{Ids: []int{1}}}); err == nil {
+		t.Error("Waiting for a forgotten task succeeded")
+	}
+	req := makeRequest(t, "true")
+	req.Run.After = []int{1}
+	if _, err := i.cmdRun(req); err == nil || !strings.Contains(err.Error(), "forgotten") {
+		t.Errorf("Depending on a forgotten task gave error %v", err)
+	}
+	// Nor are forgotten tasks reported by a wait for any task.
+	if w := wait(t, i, &RequestWait{Any: true}); len(w.Tasks) != 0 || w.ExitStatus != 5 {
+		t.Errorf("Unexpected wait for any task %+v", w)
+	}
+	i.m.Lock()
+	if n := i.unreported.Len(); n != 0 {
+		t.Errorf("Expected no unreported tasks, got %d", n)
+	}
+	i.m.Unlock()
+}
+
+func TestJoblog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := makeTestViper()
+	v.Set("start.joblog", filepath.Join(dir, "joblog"))
+	i := makeTestInstance(v)
+	var exe string
+	for _, script := range []string{"true\nexit 3", "kill $$"} {
+		req := makeRequest(t, "sh", "-c", script)
+		// The command is logged as submitted, the executable as found.
+		exe, req.Run.Args[0] = req.Run.Exe, "sh"
+		req.Run.Cwd = dir
+		waitForState(t, i, submit(t, i, req), TASK_FINISHED)
+	}
+	i.cmdShutdown(&Request{Type: REQUEST_SHUTDOWN})
+	b, err := ioutil.ReadFile(filepath.Join(dir, "joblog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 3 || lines[0]+"\n" != joblogHeader {
+		t.Fatalf("Unexpected job log %q", b)
+	}
+	b, err = ioutil.ReadFile(joblogKeysPath(filepath.Join(dir, "joblog")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(keys) != 2 {
+		t.Fatalf("Unexpected job log keys %q", b)
+	}
+	for n, want := range []struct {
+		exitval, signal, command, key string
+	}{
+		// The newline is escaped to keep the command on one line.
+		{"3", "0", `sh -c 'true'$'\n''exit 3'`, "cd " + dir + " && " + exe + ` -c 'true'$'\n''exit 3'`},
+		{"0", "15", "sh -c 'kill $$'", "cd " + dir + " && " + exe + " -c 'kill $$'"},
+	} {
+		fields := strings.Split(lines[n+1], "\t")
+		if len(fields) != 9 || fields[0] != strconv.Itoa(n+1) || fields[6] != want.exitval || fields[7] != want.signal || fields[8] != want.command {
+			t.Errorf("Unexpected job log line %q", lines[n+1])
+		}
+		if keys[n] != want.exitval+"\t"+want.signal+"\t"+want.key {
+			t.Errorf("Unexpected job log key %q", keys[n])
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := makeRequest(t, "sh").Run.Exe
+	joblog := filepath.Join(dir, "joblog")
+	err = ioutil.WriteFile(joblog, []byte(joblogHeader+
+		"1\t:\t0.000\t0.000\t0\t0\t0\t0\tsh -c 'true a'\n"+
+		"2\t:\t0.000\t0.000\t0\t0\t1\t0\tsh -c 'true b'\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(joblogKeysPath(joblog), []byte(
+		"0\t0\tcd "+dir+" && "+exe+" -c 'true a'\n"+
+			"1\t0\tcd "+dir+" && "+exe+" -c 'true b'\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resumeFailed := range []bool{false, true} {
+		v := makeTestViper()
+		v.Set("start.resume", joblog)
+		v.Set("start.resume_failed", resumeFailed)
+		newJoblog := filepath.Join(dir, fmt.Sprintf("joblog-%v", resumeFailed))
+		v.Set("start.joblog", newJoblog)
+		i := makeTestInstance(v)
+		for _, run := range []struct{ script, cwd string }{
+			{"true a", dir}, {"true b", dir}, {"true c", dir}, {"true a", "/"},
+		} {
+			req := makeRequest(t, "sh", "-c", run.script)
+			req.Run.Args[0] = "sh"
+			req.Run.Cwd = run.cwd
+			submit(t, i, req)
+		}
+		w := wait(t, i, &RequestWait{Ids: []int{1, 2, 3, 4}})
+		// "true a" succeeded, so it isn't run again. "true b" failed, so
+		// it is only run again with resume_failed. "true c" and "true a"
+		// in another directory aren't in the job log, so they run.
+		ran := []bool{false, resumeFailed, true, true}
+		for n, s := range w.Tasks {
+			failed := n == 1 && !resumeFailed
+			if (s.Resumed != "") != (n == 0) || (s.Pid != 0) != ran[n] || (s.Skipped != "") != failed || (s.ExitCode() != 0) != failed {
+				t.Errorf("With resume_failed=%v, unexpected status of task %d: %+v", resumeFailed, s.Id, s)
+			}
+		}
+		if (w.ExitStatus != 0) != !resumeFailed {
+			t.Errorf("Unexpected wait response %+v", w)
+		}
+		i.cmdShutdown(&Request{Type: REQUEST_SHUTDOWN})
+		// Tasks that weren't run are logged as they ended before, so
+		// resuming from the new job log remembers them.
+		r, err := ReadJoblog(newJoblog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.results) != 4 || !r.results[resumeKey(i.tasks[1].request.Run)].succeeded() ||
+			r.results[resumeKey(i.tasks[2].request.Run)].succeeded() != resumeFailed {
+			t.Errorf("With resume_failed=%v, unexpected new job log %+v", resumeFailed, r.results)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	joblog := filepath.Join(dir, "joblog")
+	v := makeTestViper()
+	v.Set("start.joblog", joblog)
+	v.Set("start.joblog_usage", true)
+	i := makeTestInstance(v)
+	submit(t, i, makeRequest(t, "sh", "-c", "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done"))
+	w := wait(t, i, &RequestWait{Ids: []int{1}})
+	u := w.Tasks[0].Usage
+	if u.Wall <= 0 || u.User+u.System <= 0 || u.MaxRSS <= 0 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+	if w.Ran != 1 || w.Usage != u || w.Elapsed != u.Wall {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+	i.cmdShutdown(&Request{Type: REQUEST_SHUTDOWN})
+	r, err := ReadJoblog(joblog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.byCommand || len(r.results) != 1 || !r.results[resumeKey(i.tasks[1].request.Run)].succeeded() {
+		t.Errorf("Unexpected keys read from job log: %+v", r)
+	}
+	// Without its keys file, the usage columns don't stop the log from
+	// being resumed by command line.
+	os.Remove(joblogKeysPath(joblog))
+	r, err = ReadJoblog(joblog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.byCommand || len(r.results) != 1 || !r.results[commandLine(i.tasks[1].request.Run)].succeeded() {
+		t.Errorf("Unexpected commands read from job log: %+v", r)
+	}
+}
+
+func TestStartFailures(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	unstartable := makeUnstartable(t)
+	defer os.Remove(unstartable)
+	bad := []*Request{makeRequest(t, "sh"), makeRequest(t, "sh"), makeRequest(t, "sh"), makeRequest(t, "sh")}
+	bad[0].Run.Exe = "/nonexistent"
+	bad[1].Run.Cwd = "/nonexistent"
+	bad[2].Run.Cwd = unstartable
+	bad[3].Run.Exe = os.TempDir()
+	for _, req := range bad {
+		if _, err := i.cmdRun(req); err == nil {
+			t.Errorf("Bad request %+v was accepted", req.Run)
+		}
+	}
+	if err := os.Chmod(unstartable, 0644); err != nil {
+		t.Fatal(err)
+	}
+	req := makeRequest(t, "sh")
+	req.Run.Exe = unstartable
+	if _, err := i.cmdRun(req); err == nil {
+		t.Error("A file that isn't executable was accepted")
+	}
+	if err := os.Chmod(unstartable, 0755); err != nil {
+		t.Fatal(err)
+	}
+	submit(t, i, makeRequest(t, unstartable))
+	w := wait(t, i, nil)
+	if w.ExitStatus != 1 || w.Failed != 1 || len(w.StartFailures) != 1 || w.StartFailures[0].Id != 1 || w.StartFailures[0].Error == "" {
+		t.Errorf("Unexpected wait response %+v", w)
+	}
+}
+
+// Rejected tasks don't keep the fds they were sent open.
+func TestRejectedFds(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	bad := []*Request{makeOutputRequest(t, w, "true"), makeOutputRequest(t, w, "true"), makeOutputRequest(t, w, "true")}
+	bad[0].Run.Exe = "/nonexistent"
+	bad[1].Run.Backoff = "bogus"
+	bad[2].Run.After = []int{1}
+	for _, req := range bad {
+		if _, err := i.cmdRun(req); err == nil {
+			t.Errorf("Bad request %+v was accepted", req.Run)
+		}
+	}
+	w.Close()
+	eof := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		eof <- err
+	}()
+	select {
+	case err := <-eof:
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The pipe was kept open")
+	}
+}
+
+// Returns an unlinked temporary file for capturing task output.
+func makeOutputFile(t *testing.T) *os.File {
+	f, err := ioutil.TempFile("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	return f
+}
+
+// Returns a request that runs sh -c script with f as its stdout and stderr.
+func makeOutputRequest(t *testing.T, f *os.File, script string) *Request {
+	req := makeRequest(t, "sh", "-c", script)
+	for n := 0; n < 2; n++ {
+		// The server closes received fds once the task finishes.
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ReceivedFds = append(req.ReceivedFds, fd)
+	}
+	req.HasFds = true
+	req.Fds = []int{1, 2}
+	return req
+}
+
+func readOutput(t *testing.T, f *os.File) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/dev/fd/%d", f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGroupOutput(t *testing.T) {
+	v := makeTestViper()
+	// Spill most of the output to disk.
+	v.Set("start.spill_after", 4)
+	i := makeTestInstance(v)
+	f := makeOutputFile(t)
+	defer f.Close()
+	for _, script := range []string{"echo a1; sleep 0.2; echo a2 >&2", "sleep 0.1; echo b1; sleep 0.2; echo b2"} {
+		req := makeOutputRequest(t, f, script)
+		req.Run.Output = "group"
+		submit(t, i, req)
+	}
+	wait(t, i, nil)
+	if out := readOutput(t, f); out != "a1\na2\nb1\nb2\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+	req := makeOutputRequest(t, f, "true")
+	req.Run.Output = "none"
+	if _, err := i.cmdRun(req); err == nil {
+		t.Error("Unknown output mode was accepted")
+	}
+}
+
+func TestOutputGrace(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 1)
+	i := makeTestInstance(v)
+	i.outputGrace = 300 * time.Millisecond
+	f := makeOutputFile(t)
+	defer f.Close()
+	// The background child holds task 1's pipes open after it exits.
+	req := makeOutputRequest(t, f, "echo a; sleep 3 &")
+	req.Run.Output = "group"
+	submit(t, i, req)
+	start := time.Now()
+	submit(t, i, makeOutputRequest(t, f, "echo b"))
+	// Task 2 gets the slot as soon as task 1 exits, while task 1's output
+	// is still being read.
+	waitForState(t, i, 2, TASK_FINISHED)
+	i.m.Lock()
+	state := i.tasks[1].state
+	i.m.Unlock()
+	if state != TASK_FLUSHING {
+		t.Errorf("Task 1 is %v, wanted flushing", state)
+	}
+	wait(t, i, nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Waited %v for the background child", elapsed)
+	}
+	if out := readOutput(t, f); out != "b\na\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+}
+
+// Output still in a task's pipes when its process exits isn't lost while
+// another task holds the destination.
+func TestOutputGraceSlowDestination(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	i.outputGrace = 100 * time.Millisecond
+	f := makeOutputFile(t)
+	defer f.Close()
+	lock := i.dsts.get(f)
+	defer lock.release()
+	lock.Lock()
+	// Small enough to fit in the pipe, so the task exits straight away.
+	req := makeOutputRequest(t, f, "yes 123456789 | head -n 5500")
+	req.Run.Output = "line"
+	waitForState(t, i, submit(t, i, req), TASK_FLUSHING)
+	time.Sleep(5 * i.outputGrace)
+	lock.Unlock()
+	wait(t, i, nil)
+	if out := readOutput(t, f); len(out) != 55000 {
+		t.Errorf("Got %d bytes of output", len(out))
+	}
+}
+
+func TestLinePrefix(t *testing.T) {
+	v := makeTestViper()
+	i := makeTestInstance(v)
+	f := makeOutputFile(t)
+	defer f.Close()
+	// The first line is written in two parts, and the last has no newline.
+	for _, script := range []string{"printf a; sleep 0.2; echo 1; sleep 0.1; echo a2 >&2", "sleep 0.1; echo b1; sleep 0.3; printf b2"} {
+		req := makeOutputRequest(t, f, script)
+		req.Run.Output = "line"
+		req.Run.LinePrefix = "{id} {arg1} {arg3}: "
+		submit(t, i, req)
+	}
+	wait(t, i, nil)
+	if out := readOutput(t, f); out != "2 -c : b1\n1 -c : a1\n1 -c : a2\n2 -c : b2" {
+		t.Errorf("Unexpected output %q", out)
+	}
+}
+
+// Long lines from different tasks to the same pipe aren't mixed up, although
+// they are too long to be written atomically.
+func TestLongLines(t *testing.T) {
+	i := makeTestInstance(makeTestViper())
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- string(b)
+	}()
+	for _, c := range []string{"a", "b", "c"} {
+		req := makeOutputRequest(t, w, "printf '%060000d\\n' 0 0 0 0 | tr 0 "+c)
+		req.Run.Output = "line"
+		req.Run.LinePrefix = "{id}:"
+		submit(t, i, req)
+	}
+	w.Close()
+	wait(t, i, nil)
+	lines := strings.Split(<-out, "\n")
+	if len(lines) != 13 || lines[12] != "" {
+		t.Fatalf("Got %d lines", len(lines))
+	}
+	for _, line := range lines[:12] {
+		if len(line) != 60002 {
+			t.Errorf("Got a line of %d bytes", len(line))
+		} else if line != line[:3]+strings.Repeat(line[2:3], 59999) {
+			t.Errorf("Line starting %q was mixed up", line[:10])
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := makeTestViper()
+	v.Set("socket", filepath.Join(dir, "socket"))
+	v.Set("start.spool", true)
+	v.Set("start.spool_task_max", 8)
+	v.Set("start.spool_max", 45)
+	v.Set("start.parallel", 1)
+	i := makeTestInstance(v)
+	f := makeOutputFile(t)
+	defer f.Close()
+	for _, script := range []string{"echo a1; sleep 0.1; echo a2 >&2", "echo 0123456789", "echo c1", "echo d1"} {
+		// A task's slot is freed before its output has all been copied,
+		// so finish each task before the next one starts.
+		waitForState(t, i, submit(t, i, makeOutputRequest(t, f, script)), TASK_FINISHED)
+	}
+	wait(t, i, nil)
+	// The output still reaches the task's fds in full.
+	if out := readOutput(t, f); out != "a1\na2\n0123456789\nc1\nd1\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+	// Task 1's spool file was removed to keep the total under 45 bytes.
+	expected := []string{"", "01234567\n[lateral: output truncated]\n", "c1\n", "d1\n"}
+	for n, e := range expected {
+		b, err := ioutil.ReadFile(SpoolFile(v.GetString("socket"), n+1))
+		if e == "" && !os.IsNotExist(err) {
+			t.Errorf("Task %d: expected no spool file, got %q, %v", n+1, b, err)
+		} else if e != "" && string(b) != e {
+			t.Errorf("Task %d: expected %q, got %q, %v", n+1, e, b, err)
+		}
+	}
+}
+
+// Output is spooled in full even when its destination can't be written.
+func TestSpoolBrokenPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := makeTestViper()
+	v.Set("socket", filepath.Join(dir, "socket"))
+	v.Set("start.spool", true)
+	v.Set("start.spool_task_max", 1<<20)
+	v.Set("start.spool_max", 1<<20)
+	i := makeTestInstance(v)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	defer w.Close()
+	submit(t, i, makeOutputRequest(t, w, "echo a; echo b"))
+	wait(t, i, nil)
+	if b, err := ioutil.ReadFile(SpoolFile(v.GetString("socket"), 1)); string(b) != "a\nb\n" {
+		t.Errorf("Unexpected spool file %q, %v", b, err)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lateral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "in.x"), []byte("input\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	v := makeTestViper()
+	i := makeTestInstance(v)
+	// Task 2's stdin doesn't exist, so it can't be started.
+	for _, arg := range []string{"x", "y"} {
+		req := makeRequest(t, "sh", "-c", "cat; echo err >&2", arg)
+		req.Run.Cwd = dir
+		req.Run.Stdin = "in.{arg3}"
+		req.Run.Stdout = "{id}.out"
+		req.Run.Stderr = filepath.Join(dir, "{id}.out")
+		submit(t, i, req)
+	}
+	w := wait(t, i, &RequestWait{Ids: []int{1, 2}})
+	if code := w.Tasks[0].ExitCode(); code != 0 {
+		t.Errorf("Task 1 exited with %d", code)
+	}
+	if code := w.Tasks[1].ExitCode(); code != 127 {
+		t.Errorf("Task 2 exited with %d, expected 127", code)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "1.out"))
+	if string(b) != "input\nerr\n" {
+		t.Errorf("Unexpected output %q, %v", b, err)
+	}
+}
+
+func TestKeepOrder(t *testing.T) {
+	v := makeTestViper()
+	v.Set("start.parallel", 2)
+	// Spill most of the output to disk.
+	v.Set("start.buffer_max", 4)
+	i := makeTestInstance(v)
+	f := makeOutputFile(t)
+	defer f.Close()
+	// Task 3 only gets a slot once task 2 has finished, and task 4 is
+	// skipped because task 3 fails.
+	scripts := []string{"sleep 0.3; echo a1; echo a2 >&2", "echo b", "echo c; exit 1", "echo d", "echo e"}
+	for n, script := range scripts {
+		req := makeOutputRequest(t, f, script)
+		req.Run.Output = "keep"
+		if n == 3 {
+			req.Run.After = []int{3}
+		}
+		submit(t, i, req)
+	}
+	// Task 2 has exited but holds its output until task 1 is done, so
+	// there's nothing left to cancel.
+	waitForState(t, i, 2, TASK_FLUSHING)
+	resp, err := i.cmdCancel(&Request{Type: REQUEST_CANCEL, Cancel: &RequestCancel{Ids: []int{2}}})
+	if err != nil {
+		t.Fatal("got error", err)
+	} else if len(resp.Cancel.Finished) != 1 || resp.Cancel.Finished[0] != 2 {
+		t.Errorf("Unexpected cancel response %+v", resp.Cancel)
+	}
+	wait(t, i, nil)
+	if out := readOutput(t, f); out != "a1\na2\nb\nc\ne\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+	resp, err = i.cmdStatus(&Request{Type: REQUEST_STATUS, Status: &RequestStatus{}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	tasks := resp.Status.Tasks
+	if tasks[1].Cancelled || tasks[1].ExitStatus != 0 {
+		t.Errorf("Task 2 was disturbed: %+v", tasks[1])
+	}
+	// The later tasks ran while task 1 was still running.
+	for _, n := range []int{1, 2, 4} {
+		if !tasks[n].Ended.Before(tasks[0].Ended) {
+			t.Errorf("Task %d didn't run alongside task 1: %+v", n+1, tasks[n])
+		}
+	}
+}
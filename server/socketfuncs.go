@@ -69,6 +69,11 @@ func readRequest(c *net.UnixConn) (*Request, error) {
 		}
 		fds = append(fds, tfds...)
 	}
+	// The fds are held until the task is finished, and must not leak into
+	// other tasks started in the meantime.
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+	}
 	if len(fds) == 0 {
 		return nil, fmt.Errorf("Failed to receive any FDs on a request with HasFds == true")
 	}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// With start.spool set, the server keeps a copy of each task's output in a
+// spool directory next to its socket, so lateral logs can print it later. Each
+// task's file holds at most start.spool_task_max bytes, and once the files of
+// finished tasks add up to more than start.spool_max bytes, the oldest are
+// removed.
+
+// SpoolDir returns the directory in which a server listening on socket keeps
+// its tasks' output.
+func SpoolDir(socket string) string {
+	return socket + ".spool"
+}
+
+// SpoolFile returns the file in which a server listening on socket keeps the
+// output of task id.
+func SpoolFile(socket string, id int) string {
+	return filepath.Join(SpoolDir(socket), strconv.Itoa(id))
+}
+
+// Empty the spool directory left by any earlier server on the same socket,
+// since task IDs start again at 1. Spooling is disabled if that fails.
+func (i *instance) openSpoolDir() {
+	dir := SpoolDir(i.viper.GetString("socket"))
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		glog.Errorln("Not spooling task output:", err)
+		return
+	}
+	i.spoolDir = dir
+}
+
+// Copies a task's output to its spool file, up to a limit. Both of the task's
+// streams share one, and it never fails, so a problem with the spool doesn't
+// affect the output's other destination.
+type spoolWriter struct {
+	m sync.Mutex
+	// nil once the file can't be written
+	f *os.File
+	// Bytes that can still be written before the limit
+	left int64
+}
+
+// Open the spool file of t for an attempt at running it, keeping what
+// earlier attempts wrote. Returns nil if the server isn't spooling.
+func (i *instance) openSpool(t *task) *spoolWriter {
+	if i.spoolDir == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(i.spoolDir, strconv.Itoa(t.id)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		glog.Errorf("Error spooling output of task %d: %v", t.id, err)
+		return nil
+	}
+	s := &spoolWriter{f: f, left: int64(i.viper.GetInt("start.spool_task_max"))}
+	if info, err := f.Stat(); err == nil {
+		s.left -= info.Size()
+	}
+	return s
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.f == nil || s.left <= 0 {
+		return len(p), nil
+	}
+	q := p
+	if int64(len(q)) > s.left {
+		q = q[:s.left]
+	}
+	n, err := s.f.Write(q)
+	s.left -= int64(n)
+	if err == nil && s.left <= 0 {
+		// Later attempts find the file full, and write nothing more.
+		_, err = fmt.Fprintf(s.f, "\n[lateral: output truncated]\n")
+	}
+	if err != nil {
+		glog.Errorln("Error spooling task output:", err)
+		s.Close()
+	}
+	return len(p), nil
+}
+
+func (s *spoolWriter) Close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+// Count the spool file of the finished task t toward the total, and remove
+// the oldest files while the total is over the limit. The files are counted
+// and removed in the background. Must be called with i.m held.
+func (i *instance) accountSpool(t *task) {
+	if i.spoolDir == "" || len(t.attempts) == 0 {
+		return
+	}
+	id, max := t.id, int64(i.viper.GetInt("start.spool_max"))
+	i.work.add(func() {
+		info, err := os.Stat(filepath.Join(i.spoolDir, strconv.Itoa(id)))
+		if err != nil {
+			return // Never spooled, or the file couldn't be created.
+		}
+		i.spoolSize += info.Size()
+		i.spooled = append(i.spooled, spooled{id, info.Size()})
+		for len(i.spooled) > 0 && i.spoolSize > max {
+			s := i.spooled[0]
+			os.Remove(filepath.Join(i.spoolDir, strconv.Itoa(s.id)))
+			i.spoolSize -= s.size
+			i.spooled = i.spooled[1:]
+		}
+	})
+}
+
+// A finished task's spool file
+type spooled struct {
+	id   int
+	size int64
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"container/list"
+	"os"
+	"syscall"
+	"time"
+)
+
+// A task is a single submitted RequestRun and its server-side identity.
+type task struct {
+	id        int
+	request   *Request
+	state     TaskState
+	submitted time.Time
+	// One entry per time the task was run, most recent last.
+	attempts []*attempt
+
+	// Tasks with a higher priority are run first.
+	priority int
+	group    *group
+	// The task's position in its group's queue, or nil if not queued
+	elem *list.Element
+
+	// Number of dependencies that haven't finished yet
+	waitingOn int
+	// Pending tasks waiting for this one to finish
+	dependents []*task
+	// If non-empty, the task was finished without being run, for this reason.
+	skipped string
+	// If non-empty, the task was treated as having succeeded without being
+	// run, because of the job log given to --resume, for this reason.
+	resumed string
+	// How the task ended in the job log given to --resume, if it wasn't run
+	// because of it.
+	logged *jobResult
+	// The task was cancelled, either before it ran or by sending the running
+	// process cancelSignal.
+	cancelled    bool
+	cancelSignal syscall.Signal
+	// Position in the order tasks finished, starting at 1, or 0 if the task
+	// hasn't finished.
+	finishSeq  int
+	finishedAt time.Time
+	// The task's element in instance.unreported, or nil once a wait for any
+	// task has reported it
+	unreported *list.Element
+	// Output of each attempt, held until it can be written in order
+	held []*capture
+}
+
+// A single run of a task's process.
+type attempt struct {
+	// nil until the process has been started
+	process *os.Process
+	pid     int
+	started time.Time
+	ended   time.Time
+	// nil if the attempt hasn't finished or couldn't be started
+	ps *os.ProcessState
+	// Why the process couldn't be started, if it couldn't
+	startErr string
+	// The attempt exceeded its timeout and was signalled
+	timedOut bool
+}
+
+// Functions computing the delay before retry n (starting at 1), given the
+// task's RetryDelay.
+var backoffs = map[string]func(delay time.Duration, n int) time.Duration{
+	"":       func(delay time.Duration, n int) time.Duration { return delay },
+	"const":  func(delay time.Duration, n int) time.Duration { return delay },
+	"linear": func(delay time.Duration, n int) time.Duration { return delay * time.Duration(n) },
+	"exp":    expBackoff,
+}
+
+// Longest delay exponential backoff grows to, unless RetryDelay is longer.
+const maxRetryDelay = time.Hour
+
+// Double the delay for each retry after the first, up to maxRetryDelay.
+func expBackoff(delay time.Duration, n int) time.Duration {
+	d := delay
+	for ; n > 1 && d > 0 && d < maxRetryDelay; n-- {
+		d *= 2
+	}
+	if d > maxRetryDelay && d > delay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// Returns the most recent attempt, or nil if the task has never been run.
+func (t *task) lastAttempt() *attempt {
+	if len(t.attempts) == 0 {
+		return nil
+	}
+	return t.attempts[len(t.attempts)-1]
+}
+
+// Whether the task ran, and its final attempt exited successfully.
+func (t *task) succeeded() bool {
+	a := t.lastAttempt()
+	return t.state == TASK_FINISHED && (t.resumed != "" || (a != nil && a.succeeded()))
+}
+
+// Whether the attempt's process was started and exited successfully.
+func (a *attempt) succeeded() bool {
+	return a.ps != nil && a.ps.Success()
+}
+
+// The exit status of a finished task as a shell would report it: see
+// TaskStatus.ExitCode.
+func (t *task) exitCode() int {
+	a := t.lastAttempt()
+	switch {
+	case t.resumed != "":
+		return 0
+	case a == nil:
+		return 1
+	case a.ps == nil:
+		return 127
+	}
+	if ws, ok := a.ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return a.ps.ExitCode()
+}
+
+// Whether the most recent attempt failed in a way that should be retried.
+func (t *task) shouldRetry() bool {
+	r := t.request.Run
+	a := t.lastAttempt()
+	// Processes that couldn't be started won't do better next time.
+	if t.cancelled || a == nil || a.ps == nil || a.ps.Success() || len(t.attempts) > r.Retries {
+		return false
+	}
+	if len(r.RetryOn) == 0 {
+		return true
+	}
+	code := a.ps.ExitCode()
+	for _, c := range r.RetryOn {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// The delay before retrying the most recent attempt.
+func (t *task) retryDelay() time.Duration {
+	r := t.request.Run
+	return backoffs[r.Backoff](r.RetryDelay, len(t.attempts))
+}
+
+// Close the fds received with the task's request.
+func (t *task) closeFds() {
+	for _, fd := range t.request.ReceivedFds {
+		syscall.Close(fd)
+	}
+}
+
+// Returns the resources used by the attempt's process, or nothing if it
+// hasn't exited.
+func (a *attempt) usage() Usage {
+	if a.ps == nil {
+		return Usage{}
+	}
+	u := Usage{
+		Wall:   a.ended.Sub(a.started),
+		User:   a.ps.UserTime(),
+		System: a.ps.SystemTime(),
+	}
+	if ru, ok := a.ps.SysUsage().(*syscall.Rusage); ok {
+		// Linux and FreeBSD both report kilobytes.
+		u.MaxRSS = int64(ru.Maxrss) * 1024
+		u.InBlock = int64(ru.Inblock)
+		u.OutBlock = int64(ru.Oublock)
+		u.VoluntaryCtxSw = int64(ru.Nvcsw)
+		u.InvoluntaryCtxSw = int64(ru.Nivcsw)
+	}
+	return u
+}
+
+// Summarize a for a status response.
+func (a *attempt) status() AttemptStatus {
+	s := AttemptStatus{
+		Pid:        a.pid,
+		Started:    a.started,
+		Ended:      a.ended,
+		ExitStatus: -1,
+		TimedOut:   a.timedOut,
+		Usage:      a.usage(),
+		StartError: a.startErr,
+	}
+	if a.ps != nil {
+		s.ExitStatus = a.ps.ExitCode()
+		if ws, ok := a.ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			s.Signal = int(ws.Signal())
+		}
+	}
+	return s
+}
+
+// Summarize t for a status response. Must be called with the instance's
+// mutex held.
+func (t *task) status() TaskStatus {
+	s := TaskStatus{
+		Id:        t.id,
+		State:     t.state,
+		Args:      t.request.Run.Args,
+		Cwd:       t.request.Run.Cwd,
+		Submitted: t.submitted,
+		Priority:  t.priority,
+		Group:     t.group.name,
+		After:     t.request.Run.After,
+		Skipped:   t.skipped,
+		Resumed:   t.resumed,
+		Cancelled: t.cancelled,
+	}
+	for _, a := range t.attempts {
+		s.Attempts = append(s.Attempts, a.status())
+	}
+	if a := t.lastAttempt(); a != nil && t.state != TASK_PENDING {
+		last := s.Attempts[len(s.Attempts)-1]
+		s.Pid = last.Pid
+		s.Started = last.Started
+		if t.state == TASK_FINISHED {
+			s.Ended = last.Ended
+			s.ExitStatus = last.ExitStatus
+			s.Signal = last.Signal
+			s.TimedOut = last.TimedOut
+			s.Usage = last.Usage
+			s.StartError = last.StartError
+		}
+	}
+	return s
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Placeholders in templates such as line prefixes.
+var placeholder = regexp.MustCompile(`\{(id|group|args|arg[0-9]+)\}`)
+
+// Expand the placeholders in s for task t. {id} is the task's ID, {group} its
+// group, {args} its arguments separated by spaces, and {argN} argument N, where
+// arg0 is the command itself, or "" if there are fewer arguments. Anything else
+// is left as it is.
+func expandTemplate(s string, t *task) string {
+	args := t.request.Run.Args
+	return placeholder.ReplaceAllStringFunc(s, func(p string) string {
+		name := p[1 : len(p)-1]
+		switch name {
+		case "id":
+			return strconv.Itoa(t.id)
+		case "group":
+			return t.group.name
+		case "args":
+			if len(args) == 0 {
+				return ""
+			}
+			return strings.Join(args[1:], " ")
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(name, "arg"))
+		if n < len(args) {
+			return args[n]
+		}
+		return ""
+	})
+}
@@ -1,5 +1,7 @@
 package server
 
+import "time"
+
 type RequestType int
 
 const (
@@ -9,6 +11,9 @@ const (
 	REQUEST_KILL
 	REQUEST_SHUTDOWN
 	REQUEST_CONFIG
+	REQUEST_STATUS
+	REQUEST_REPRIORITIZE
+	REQUEST_CANCEL
 )
 
 type Request struct {
@@ -18,9 +23,13 @@ type Request struct {
 	Fds []int
 	// Filled in on receiving side - list of fd numbers corresponding to
 	// the original FD numbers above
-	ReceivedFds []int
-	Run         *RequestRun
-	Config      *RequestConfig
+	ReceivedFds  []int
+	Run          *RequestRun
+	Config       *RequestConfig
+	Status       *RequestStatus
+	Reprioritize *RequestReprioritize
+	Wait         *RequestWait
+	Cancel       *RequestCancel
 }
 
 type RequestRun struct {
@@ -29,11 +38,144 @@ type RequestRun struct {
 	Args []string
 	Env  []string
 	Cwd  string
+	// If the task runs longer than Timeout it is sent SIGTERM, and SIGKILL if it
+	// is still running KillAfter later. Zero values use the server's defaults.
+	Timeout   time.Duration
+	KillAfter time.Duration
+	// Number of times to re-run the task if it fails.
+	Retries int
+	// Delay before the first retry, scaled for later retries by Backoff.
+	RetryDelay time.Duration
+	// One of "const" (the default), "linear" or "exp".
+	Backoff string
+	// If non-empty, only these exit statuses are retried.
+	RetryOn []int
+	// Pending tasks with a higher priority are run first. Tasks with equal
+	// priority are run in the order they were submitted.
+	Priority int
+	// Tasks in a group are limited by the group's parallelism as well as the
+	// server's. "" is the default group, which has no limit of its own.
+	Group string
+	// IDs of tasks that must finish successfully before this one is run.
+	// If any of them fails, this task is skipped.
+	After []int
+	// How the task's stdout and stderr reach the received fds:
+	//   "" (the default): the task writes to them directly.
+	//   "group": the server buffers the output, and writes it in one piece
+	//     once the task exits, so it isn't mixed up with other tasks' output.
+	//   "line": the server writes the output a line at a time, each after
+	//     LinePrefix, so lines from different tasks aren't mixed up.
+	//   "keep": as "group", but the output is also written in the order the
+	//     tasks were submitted, after that of every earlier task in "keep"
+	//     mode in the same group.
+	Output string
+	// In "line" mode, a prefix for each line, with placeholders such as {id}
+	// and {arg1} as described for lateral run.
+	LinePrefix string
+	// In "line" mode, start each line with the time it was written, and
+	// color the prefix differently for each task.
+	Timestamp bool
+	Color     bool
+	// If set, the server opens these files for the task's stdin, stdout and
+	// stderr when it starts, in place of any fds received for them. They may
+	// contain the same placeholders as LinePrefix, and relative paths are
+	// relative to Cwd. Stdout and Stderr are truncated by each attempt.
+	Stdin  string
+	Stdout string
+	Stderr string
+}
+
+type RequestWait struct {
+	// Only wait for, and report on, tasks with these IDs. Takes precedence
+	// over Group.
+	Ids []int
+	// Only wait for, and report on, tasks in this group. "" means all tasks.
+	Group string
+	// How skipped tasks affect the exit status: "fail" (the default) counts
+	// them as failures, "ignore" doesn't count them.
+	Skipped string
+	// How the exit status is computed from the tasks that failed:
+	//   "any" (the default): 1 if any task failed, or 3 or 4 if one timed out
+	//     or the server halted.
+	//   "all": 1 only if every task failed.
+	//   "max": the highest exit code of any task, as in TaskStatus.ExitCode.
+	//   "first": the exit code of the first task to fail.
+	//   "count": the number of failed tasks, up to 125.
+	// Only "any" and "all" can be combined with Any or Timeout.
+	ExitPolicy string
+	// Return as soon as one task finishes that no earlier wait with Any set
+	// has reported, and report only that task. The exit status is 5 if there
+	// are no such tasks left. Only finished tasks of the current epoch that
+	// haven't been forgotten are reported.
+	Any bool
+	// If non-zero, give up waiting after this long, with exit status 124.
+	Timeout time.Duration
+	// Also wait for, and report on, tasks submitted after the wait started.
+	// Otherwise the wait is a barrier for the tasks already submitted.
+	Drain bool
+	// After reporting, start a new epoch. Waits only report on tasks
+	// submitted in the current epoch, and a new epoch also clears the
+	// server's halt.
+	Reset bool
 }
 
 type RequestConfig struct {
 	// nil indicates lack of presence
 	Parallel *int
+	// If set, Parallel applies to this group rather than the whole server.
+	// A negative value removes the group's limit.
+	Group string
+}
+
+type RequestReprioritize struct {
+	// ID of a pending task
+	Id       int
+	Priority int
+}
+
+// Pending tasks are removed from the queue and never run. Running tasks are
+// sent Signal. Either way, the tasks are recorded as cancelled.
+type RequestCancel struct {
+	Ids []int
+	// Cancel every pending task.
+	AllPending bool
+	// Cancel every running task.
+	Running bool
+	// Signal sent to running tasks. 0 means SIGTERM.
+	Signal int
+}
+
+type RequestStatus struct {
+	// Only report tasks in one of these states. Empty reports all tasks.
+	States []TaskState
+	// Only report tasks in this group, if set.
+	Group string
+}
+
+// The lifecycle of a task on the server.
+type TaskState int
+
+const (
+	TASK_PENDING TaskState = iota
+	TASK_RUNNING
+	TASK_FINISHED
+	// The task's process has exited and given up its slot, but its output
+	// hasn't all been written yet.
+	TASK_FLUSHING
+)
+
+func (s TaskState) String() string {
+	switch s {
+	case TASK_PENDING:
+		return "pending"
+	case TASK_RUNNING:
+		return "running"
+	case TASK_FINISHED:
+		return "finished"
+	case TASK_FLUSHING:
+		return "flushing"
+	}
+	return "unknown"
 }
 
 // The server's response.
@@ -45,6 +187,9 @@ const (
 	RESPONSE_OK
 	RESPONSE_GETPID
 	RESPONSE_WAIT
+	RESPONSE_RUN
+	RESPONSE_STATUS
+	RESPONSE_CANCEL
 )
 
 type Response struct {
@@ -52,6 +197,9 @@ type Response struct {
 	Message string
 	Getpid  *ResponseGetpid
 	Wait    *ResponseWait
+	Run     *ResponseRun
+	Status  *ResponseStatus
+	Cancel  *ResponseCancel
 }
 
 type ResponseGetpid struct {
@@ -60,4 +208,155 @@ type ResponseGetpid struct {
 
 type ResponseWait struct {
 	ExitStatus int
+	// Number of finished tasks that exited unsuccessfully or couldn't be
+	// started, not counting those that timed out.
+	Failed int
+	// The tasks that couldn't be started, ordered by ID. Tasks forgotten
+	// under the server's history limits aren't listed.
+	StartFailures []StartFailure
+	// Number of finished tasks that were stopped for exceeding their timeout.
+	TimedOut int
+	// Number of tasks that were never run because a dependency failed.
+	Skipped int
+	// Number of tasks that were cancelled. They don't count as failures.
+	Cancelled int
+	// Number of tasks that weren't run because of the server's --resume job
+	// log. They count as successes.
+	Resumed int
+	// Number of tasks that ran, whether or not they succeeded, and the total
+	// of the resources used by all their attempts
+	Ran   int
+	Usage Usage
+	// Time from the first of those tasks starting to the last one exiting
+	Elapsed time.Duration
+	// Why the server halted under its halt policy, or "" if it didn't.
+	Halted string
+	// The tasks waited for, in the order they were requested. Only filled in
+	// when waiting for specific IDs, or for any task.
+	Tasks []TaskStatus
+	// The wait's timeout passed before the tasks finished. Nothing else is
+	// filled in.
+	Expired bool
+}
+
+type StartFailure struct {
+	Id    int
+	Error string
+}
+
+type ResponseCancel struct {
+	// IDs of pending tasks that were cancelled
+	Cancelled []int
+	// IDs of running tasks that were signalled
+	Signalled []int
+	// IDs of tasks that had already finished, or whose process had exited, and
+	// were left alone
+	Finished []int
+}
+
+type ResponseRun struct {
+	// ID assigned to the task by the server. IDs start at 1 and increase
+	// monotonically for the lifetime of the server.
+	Id int
+}
+
+type ResponseStatus struct {
+	// Tasks ordered by ID
+	Tasks []TaskStatus
+}
+
+type TaskStatus struct {
+	Id    int
+	State TaskState
+	Args  []string
+	Cwd   string
+	// Priority the task was submitted with, or reprioritized to.
+	Priority int
+	Group    string
+	After    []int
+	// Why the task was finished without being run, if it was.
+	Skipped string
+	// Why the task was treated as having succeeded without being run, if it
+	// was, because of the server's --resume job log.
+	Resumed   string
+	Cancelled bool
+	// 0 if the task was never started
+	Pid int
+	// Zero values indicate the task has not reached that point yet.
+	Submitted time.Time
+	Started   time.Time
+	Ended     time.Time
+	// Only meaningful for finished tasks. ExitStatus is -1 if the task was
+	// killed by a signal or could not be started.
+	ExitStatus int
+	// Signal that killed the task, or 0.
+	Signal int
+	// The task was signalled because it exceeded its timeout.
+	TimedOut bool
+	// Resources used by the task, if it has finished.
+	Usage Usage
+	// Why the task couldn't be started, if it couldn't.
+	StartError string
+	// Every time the task was run, oldest first. The fields above describe
+	// the most recent one.
+	Attempts []AttemptStatus
+}
+
+// ExitCode returns a finished task's exit status the way a shell would report
+// it: the exit code, or 128 plus the number of the signal that killed it.
+// Tasks that couldn't be started return 127, and tasks that were never run
+// return 1.
+func (s *TaskStatus) ExitCode() int {
+	switch {
+	case s.Resumed != "":
+		return 0
+	case s.Signal != 0:
+		return 128 + s.Signal
+	case len(s.Attempts) == 0:
+		return 1
+	case s.Pid == 0 || s.ExitStatus < 0:
+		return 127
+	}
+	return s.ExitStatus
+}
+
+type AttemptStatus struct {
+	Pid        int
+	Started    time.Time
+	Ended      time.Time
+	ExitStatus int
+	Signal     int
+	TimedOut   bool
+	Usage      Usage
+	StartError string
+}
+
+// Resources used by a task's process, as reported by getrusage(2).
+type Usage struct {
+	// Time from the process starting to exiting
+	Wall   time.Duration
+	User   time.Duration
+	System time.Duration
+	// Peak resident set size, in bytes
+	MaxRSS int64
+	// Number of blocks read and written by the filesystem
+	InBlock  int64
+	OutBlock int64
+	// Number of voluntary and involuntary context switches
+	VoluntaryCtxSw   int64
+	InvoluntaryCtxSw int64
+}
+
+// Add o's usage to u. MaxRSS becomes the larger of the two.
+func (u *Usage) Add(o Usage) {
+	u.Wall += o.Wall
+	u.User += o.User
+	u.System += o.System
+	if o.MaxRSS > u.MaxRSS {
+		u.MaxRSS = o.MaxRSS
+	}
+	u.InBlock += o.InBlock
+	u.OutBlock += o.OutBlock
+	u.VoluntaryCtxSw += o.VoluntaryCtxSw
+	u.InvoluntaryCtxSw += o.InvoluntaryCtxSw
 }
@@ -0,0 +1,50 @@
+package server
+
+import "sync"
+
+// Filesystem work that finishing a task gives rise to, like writing the job
+// log, is done by a goroutine of its own, so a slow disk doesn't hold up the
+// server while i.m is held. Work is done in the order it was added, and never
+// takes i.m.
+type workQueue struct {
+	m     sync.Mutex
+	added *sync.Cond
+	work  []func()
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{}
+	q.added = sync.NewCond(&q.m)
+	go q.run()
+	return q
+}
+
+// Do f after the work added before it.
+func (q *workQueue) add(f func()) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.work = append(q.work, f)
+	q.added.Signal()
+}
+
+// Block until the work added so far has been done.
+func (q *workQueue) sync() {
+	done := make(chan struct{})
+	q.add(func() { close(done) })
+	<-done
+}
+
+func (q *workQueue) run() {
+	for {
+		q.m.Lock()
+		for len(q.work) == 0 {
+			q.added.Wait()
+		}
+		work := q.work
+		q.work = nil
+		q.m.Unlock()
+		for _, f := range work {
+			f()
+		}
+	}
+}